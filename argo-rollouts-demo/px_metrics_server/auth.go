@@ -0,0 +1,317 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authConfig holds the authentication and rate limiting settings, read from the environment.
+// Authentication is enabled when tokens or a client CA are configured.
+type authConfig struct {
+	// tokensDir is a mounted Secret with one key per caller: the key is the caller name and the
+	// value its bearer token.
+	tokensDir string
+	// TLS serving certificate, and the CA client certificates are verified against for mTLS.
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	// rateLimit is the sustained number of requests per second allowed per caller, and
+	// rateBurst the number of requests a caller can make at once. 0 disables rate limiting.
+	rateLimit float64
+	rateBurst int
+}
+
+func authConfigFromEnv() (authConfig, error) {
+	c := authConfig{
+		tokensDir:       os.Getenv("PX_AUTH_TOKENS_DIR"),
+		tlsCertFile:     os.Getenv("PX_TLS_CERT_FILE"),
+		tlsKeyFile:      os.Getenv("PX_TLS_KEY_FILE"),
+		tlsClientCAFile: os.Getenv("PX_TLS_CLIENT_CA_FILE"),
+	}
+	if (c.tlsCertFile == "") != (c.tlsKeyFile == "") {
+		return c, fmt.Errorf("`PX_TLS_CERT_FILE` and `PX_TLS_KEY_FILE` must be set together")
+	}
+	if c.tlsClientCAFile != "" && c.tlsCertFile == "" {
+		return c, fmt.Errorf("`PX_TLS_CLIENT_CA_FILE` requires `PX_TLS_CERT_FILE` and `PX_TLS_KEY_FILE`")
+	}
+	if s := os.Getenv("PX_RATE_LIMIT"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return c, fmt.Errorf("invalid `PX_RATE_LIMIT` %q: must be a number of requests per second", s)
+		}
+		c.rateLimit = v
+	}
+	c.rateBurst = int(math.Ceil(c.rateLimit))
+	if s := os.Getenv("PX_RATE_BURST"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 {
+			return c, fmt.Errorf("invalid `PX_RATE_BURST` %q: must be a positive integer", s)
+		}
+		c.rateBurst = v
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS config of the server, or nil when serving plain HTTP.
+func (c authConfig) tlsConfig() (*tls.Config, error) {
+	if c.tlsCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.tlsClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.tlsClientCAFile)
+		}
+		config.ClientCAs = pool
+		// Client certificates are checked per request rather than during the handshake, so
+		// that the kubelet probes and bearer token callers can connect without one.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// How often the tokens are reloaded, so that updates to the mounted Secret are picked up.
+const tokenReloadInterval = 30 * time.Second
+
+// tokenStore holds the bearer tokens of the callers.
+type tokenStore struct {
+	dir string
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	// tokens maps the callers to their tokens.
+	tokens map[string]string
+}
+
+func newTokenStore(dir string) (*tokenStore, error) {
+	s := &tokenStore{dir: dir}
+	tokens, err := loadTokens(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", dir)
+	}
+	s.tokens, s.loadedAt = tokens, time.Now()
+	return s, nil
+}
+
+// loadTokens reads one token per file. Kubernetes mounts Secrets with hidden bookkeeping
+// entries such as `..data`, which are skipped.
+func loadTokens(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			// Entries such as subdirectories aren't tokens.
+			continue
+		}
+		if token := strings.TrimSpace(string(data)); token != "" {
+			tokens[e.Name()] = token
+		}
+	}
+	return tokens, nil
+}
+
+// caller returns the caller owning token, or "" if no caller does.
+func (s *tokenStore) caller(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.loadedAt) > tokenReloadInterval {
+		// Keep the previous tokens if the Secret is being updated or was emptied by mistake.
+		if tokens, err := loadTokens(s.dir); err != nil {
+			log.Printf("Failed to reload tokens, keeping the previous ones: %s\n", err.Error())
+		} else if len(tokens) > 0 {
+			s.tokens = tokens
+		}
+		s.loadedAt = time.Now()
+	}
+	// Compare against every token in constant time so response times don't leak tokens.
+	found := ""
+	for name, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = name
+		}
+	}
+	return found
+}
+
+// rateLimiter is a token bucket per caller.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket), lastPrune: time.Now()}
+}
+
+// How often the buckets of idle callers are dropped.
+const rateLimiterPruneInterval = time.Minute
+
+// allow takes a token from the caller's bucket. If it is empty, it returns false and how long
+// until the next token.
+func (l *rateLimiter) allow(caller string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastPrune) > rateLimiterPruneInterval {
+		// A bucket that would have refilled is the same as a new one.
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[caller] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Paths served without authentication, for the kubelet.
+var unauthenticatedPaths = map[string]bool{
+	"/livez":  true,
+	"/readyz": true,
+}
+
+// authHandler authenticates the requests to the metrics endpoints with a bearer token or a
+// verified client certificate, and rate limits them per caller.
+type authHandler struct {
+	next http.Handler
+	// tokens is nil when bearer tokens aren't configured.
+	tokens *tokenStore
+	// mtls is set when client certificates are verified.
+	mtls    bool
+	limiter *rateLimiter
+}
+
+func newAuthHandler(next http.Handler, c authConfig) (http.Handler, error) {
+	h := &authHandler{next: next, mtls: c.tlsClientCAFile != ""}
+	if c.tokensDir != "" {
+		tokens, err := newTokenStore(c.tokensDir)
+		if err != nil {
+			return nil, err
+		}
+		h.tokens = tokens
+	}
+	if c.rateLimit > 0 {
+		h.limiter = newRateLimiter(c.rateLimit, c.rateBurst)
+	}
+	if h.tokens == nil && !h.mtls {
+		log.Println("Authentication is disabled. Set `PX_AUTH_TOKENS_DIR` or `PX_TLS_CLIENT_CA_FILE` to enable it.")
+	}
+	return h, nil
+}
+
+// authenticate returns the name of the caller, or an error if it couldn't be authenticated.
+// Without authentication, callers are told apart by IP address for rate limiting.
+func (h *authHandler) authenticate(req *http.Request) (string, error) {
+	if h.mtls && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return "cert:" + req.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+	if auth := req.Header.Get("Authorization"); h.tokens != nil && strings.HasPrefix(auth, "Bearer ") {
+		if caller := h.tokens.caller(strings.TrimPrefix(auth, "Bearer ")); caller != "" {
+			return "token:" + caller, nil
+		}
+		return "", fmt.Errorf("invalid bearer token")
+	}
+	if h.tokens == nil && !h.mtls {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		return "ip:" + host, nil
+	}
+	switch {
+	case h.tokens != nil && h.mtls:
+		return "", fmt.Errorf("a bearer token or client certificate is required")
+	case h.tokens != nil:
+		return "", fmt.Errorf("a bearer token is required")
+	}
+	return "", fmt.Errorf("a client certificate is required")
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if unauthenticatedPaths[req.URL.Path] {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	caller, err := h.authenticate(req)
+	if err != nil {
+		if h.tokens != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="px-metrics"`)
+		}
+		writeError(w, &statusError{status: http.StatusUnauthorized, err: err})
+		return
+	}
+	if h.limiter != nil {
+		if ok, retryAfter := h.limiter.allow(caller); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, newStatusError(http.StatusTooManyRequests, "rate limit exceeded for %s", caller))
+			return
+		}
+	}
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,590 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"px.dev/pxapi"
+	pxTypes "px.dev/pxapi/types"
+)
+
+// PxL script snapshotting the inbound traffic of the target pods: the overall error rate and
+// latency quantiles, and the request count of each endpoint.
+const baselinePxlScript = `import px
+
+POD_NAMESPACE=%[1]s
+POD_NAME=%[2]s
+START_TIME=%[3]s
+
+df = px.DataFrame(table='http_events', start_time=START_TIME)
+df.namespace = df.ctx['namespace']
+df.pod = df.ctx['pod']
+df = df[df.trace_role == 2]
+df = df[df.namespace == POD_NAMESPACE]
+df = df[%[5]s]
+%[4]s
+
+stats = df.agg(
+    req_count=('latency', px.count),
+    error_count=('failure', px.sum),
+    latency=('latency', px.quantiles)
+)
+stats.latency_p50 = px.pluck_float64(stats.latency, 'p50')
+stats.latency_p90 = px.pluck_float64(stats.latency, 'p90')
+stats.latency_p99 = px.pluck_float64(stats.latency, 'p99')
+px.display(stats[['req_count', 'error_count', 'latency_p50', 'latency_p90', 'latency_p99']], 'traffic_stats')
+
+# The paths are templated afterwards, see templatePath.
+endpoints = df.groupby(['req_method', 'req_path']).agg(req_count=('latency', px.count))
+px.display(endpoints, 'endpoint_stats')
+`
+
+const (
+	trafficStatsTable  = "traffic_stats"
+	endpointStatsTable = "endpoint_stats"
+)
+
+const defaultDataDir = "/data"
+
+// Window of traffic captured for a baseline, and the window the canary is compared over.
+const (
+	defaultBaselineWindow = 5 * time.Minute
+	defaultCompareWindow  = 30 * time.Second
+	minWindow             = 10 * time.Second
+	maxWindow             = time.Hour
+)
+
+// Default regression thresholds of the compare endpoint.
+const (
+	defaultMaxErrorRateIncrease = 0.01
+	defaultMaxLatencyRatio      = 1.5
+	defaultMaxMixShift          = 0.2
+)
+
+// parseWindow reads the `window` query parameter, a Go duration such as `5m`.
+func parseWindow(query url.Values, def time.Duration) (time.Duration, error) {
+	s := query.Get("window")
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < minWindow || d > maxWindow {
+		return 0, fmt.Errorf("invalid window %q: must be a duration between %s and %s", s, minWindow, maxWindow)
+	}
+	return d, nil
+}
+
+func buildBaselineScript(t podTarget, c errorClassifier, window time.Duration) string {
+	startTime := fmt.Sprintf("-%ds", int(window.Seconds()))
+	return fmt.Sprintf(baselinePxlScript, pxlString(t.namespace), pxlString(t.name), pxlString(startTime),
+		c.failureColumn(), t.podFilter("df.pod"))
+}
+
+// endpointStats holds the traffic of one endpoint.
+type endpointStats struct {
+	Method string  `json:"method"`
+	Path   string  `json:"path"`
+	RPS    float64 `json:"rps"`
+	// Share is the fraction of all requests that went to this endpoint.
+	Share float64 `json:"share"`
+}
+
+// trafficSnapshot summarizes the inbound traffic of a set of pods over a time window.
+type trafficSnapshot struct {
+	Requests     int64           `json:"requests"`
+	ErrorRate    float64         `json:"error_rate"`
+	LatencyP50Ms float64         `json:"latency_p50_ms"`
+	LatencyP90Ms float64         `json:"latency_p90_ms"`
+	LatencyP99Ms float64         `json:"latency_p99_ms"`
+	Endpoints    []endpointStats `json:"endpoints"`
+}
+
+// baseline is a snapshot stored for a rollout revision.
+type baseline struct {
+	Namespace  string          `json:"namespace"`
+	Rollout    string          `json:"rollout"`
+	Revision   string          `json:"revision"`
+	Pods       string          `json:"pods"`
+	CapturedAt time.Time       `json:"captured_at"`
+	Window     string          `json:"window"`
+	Stats      trafficSnapshot `json:"stats"`
+}
+
+// Implement the TableMuxer to collect the traffic and endpoint tables into a snapshot.
+type snapshotMux struct {
+	window   time.Duration
+	snapshot trafficSnapshot
+	errors   int64
+}
+
+func (s *snapshotMux) AcceptTable(ctx context.Context, metadata pxTypes.TableMetadata) (pxapi.TableRecordHandler, error) {
+	switch metadata.Name {
+	case trafficStatsTable:
+		return &recordFuncHandler{onRecord: s.handleTrafficRecord}, nil
+	case endpointStatsTable:
+		return &recordFuncHandler{onRecord: s.handleEndpointRecord, onDone: s.finish}, nil
+	}
+	return nil, fmt.Errorf("Table %s not found", metadata.Name)
+}
+
+func (s *snapshotMux) handleTrafficRecord(r *pxTypes.Record) {
+	if v, ok := datumFloat(r.GetDatum("req_count")); ok {
+		s.snapshot.Requests = int64(v)
+	}
+	if v, ok := datumFloat(r.GetDatum("error_count")); ok {
+		s.errors = int64(v)
+	}
+	// Latencies are reported in nanoseconds.
+	if v, ok := datumFloat(r.GetDatum("latency_p50")); ok {
+		s.snapshot.LatencyP50Ms = v / 1e6
+	}
+	if v, ok := datumFloat(r.GetDatum("latency_p90")); ok {
+		s.snapshot.LatencyP90Ms = v / 1e6
+	}
+	if v, ok := datumFloat(r.GetDatum("latency_p99")); ok {
+		s.snapshot.LatencyP99Ms = v / 1e6
+	}
+}
+
+// handleEndpointRecord merges the request counts of the paths that share a template, see
+// templatePath, so that the mix of ID-bearing paths can be compared between revisions.
+func (s *snapshotMux) handleEndpointRecord(r *pxTypes.Record) {
+	method := r.GetDatum("req_method").String()
+	path := templatePath(r.GetDatum("req_path").String())
+	var count float64
+	if v, ok := datumFloat(r.GetDatum("req_count")); ok {
+		count = v
+	}
+	for i := range s.snapshot.Endpoints {
+		if e := &s.snapshot.Endpoints[i]; e.Method == method && e.Path == path {
+			e.RPS += count
+			return
+		}
+	}
+	s.snapshot.Endpoints = append(s.snapshot.Endpoints, endpointStats{Method: method, Path: path, RPS: count})
+}
+
+// finish turns the endpoint request counts into rates and shares.
+func (s *snapshotMux) finish() {
+	var total float64
+	for _, e := range s.snapshot.Endpoints {
+		total += e.RPS
+	}
+	for i := range s.snapshot.Endpoints {
+		e := &s.snapshot.Endpoints[i]
+		if total > 0 {
+			e.Share = e.RPS / total
+		}
+		e.RPS /= s.window.Seconds()
+	}
+	// Endpoints with the same share are sorted by path and method, so snapshots are stable.
+	sort.Slice(s.snapshot.Endpoints, func(i, j int) bool {
+		a, b := s.snapshot.Endpoints[i], s.snapshot.Endpoints[j]
+		if a.Share != b.Share {
+			return a.Share > b.Share
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+}
+
+func (s *snapshotMux) result() trafficSnapshot {
+	if s.snapshot.Requests != 0 {
+		s.snapshot.ErrorRate = float64(s.errors) / float64(s.snapshot.Requests)
+	}
+	if s.snapshot.Endpoints == nil {
+		s.snapshot.Endpoints = []endpointStats{}
+	}
+	return s.snapshot
+}
+
+// Implement the TableRecordHandler interface with callbacks, for tables that need no state of
+// their own.
+type recordFuncHandler struct {
+	onRecord func(r *pxTypes.Record)
+	onDone   func()
+}
+
+func (t *recordFuncHandler) HandleInit(ctx context.Context, metadata pxTypes.TableMetadata) error {
+	return nil
+}
+
+func (t *recordFuncHandler) HandleRecord(ctx context.Context, r *pxTypes.Record) error {
+	t.onRecord(r)
+	return nil
+}
+
+func (t *recordFuncHandler) HandleDone(ctx context.Context) error {
+	if t.onDone != nil {
+		t.onDone()
+	}
+	return nil
+}
+
+// snapshot captures the inbound traffic of the target pods over the window.
+func (p *pixieMetricsProvider) snapshot(ctx context.Context, t podTarget, c errorClassifier, window time.Duration) (trafficSnapshot, error) {
+	tm := &snapshotMux{window: window}
+	if err := p.executeScript(ctx, buildBaselineScript(t, c, window), tm); err != nil {
+		return trafficSnapshot{}, err
+	}
+	return tm.result(), nil
+}
+
+// baselineStore persists baselines as one JSON file per rollout revision, so they survive
+// restarts of the metrics server.
+type baselineStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newBaselineStore(dir string) (*baselineStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &baselineStore{dir: dir}, nil
+}
+
+func (s *baselineStore) path(namespace, rollout, revision string) string {
+	// All three are validated Kubernetes names, which can't contain path separators.
+	return filepath.Join(s.dir, fmt.Sprintf("%s_%s_%s.json", namespace, rollout, revision))
+}
+
+func (s *baselineStore) put(b *baseline) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Write to a temporary file first so a crash never leaves a truncated baseline behind.
+	path := s.path(b.Namespace, b.Rollout, b.Revision)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// get returns the stored baseline, or nil if there is none.
+func (s *baselineStore) get(namespace, rollout, revision string) (*baseline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := ioutil.ReadFile(s.path(namespace, rollout, revision))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// baselineKey reads and validates the rollout and revision path params.
+func baselineKey(ps httprouter.Params) (namespace, rollout, revision string, err error) {
+	namespace, rollout, revision = ps.ByName("namespace"), ps.ByName("rollout"), ps.ByName("revision")
+	if err := validateNamespace(namespace); err != nil {
+		return "", "", "", &statusError{status: http.StatusBadRequest, err: err}
+	}
+	// Rollout names are DNS-1123 subdomains and revisions pod template hashes.
+	if err := validatePodName(rollout); err != nil {
+		return "", "", "", newStatusError(http.StatusBadRequest, "invalid rollout name %q", rollout)
+	}
+	if len(revision) > dns1123LabelMaxLength || !dns1123LabelRegexp.MatchString(revision) {
+		return "", "", "", newStatusError(http.StatusBadRequest, "invalid revision %q", revision)
+	}
+	return namespace, rollout, revision, nil
+}
+
+func (p *pixieMetricsProvider) checkBaselineStore() error {
+	if p.baselines == nil {
+		return newStatusError(http.StatusServiceUnavailable, "baseline storage is not configured")
+	}
+	return nil
+}
+
+// captureBaseline snapshots the target pods and stores the snapshot as the baseline of a
+// rollout revision, replacing any previous one.
+func (p *pixieMetricsProvider) captureBaseline(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := p.checkBaselineStore(); err != nil {
+		writeError(w, err)
+		return
+	}
+	namespace, rollout, revision, err := baselineKey(ps)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	classifier, err := parseErrorClassifier(req.URL.Query())
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	window, err := parseWindow(req.URL.Query(), defaultBaselineWindow)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	target, err := p.queryTarget(req, ps)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := p.queryContext(req)
+	defer cancel()
+	stats, err := p.snapshot(ctx, target, classifier, window)
+	if err != nil {
+		writeError(w, queryError(ctx, err))
+		return
+	}
+	b := &baseline{
+		Namespace:  namespace,
+		Rollout:    rollout,
+		Revision:   revision,
+		Pods:       target.String(),
+		CapturedAt: time.Now().UTC(),
+		Window:     window.String(),
+		Stats:      stats,
+	}
+	if err := p.baselines.put(b); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Captured baseline for %s/%s revision %s: %d requests, %2.2f %% error rate.\n",
+		namespace, rollout, revision, stats.Requests, stats.ErrorRate*100)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// getBaseline returns the stored baseline of a rollout revision.
+func (p *pixieMetricsProvider) getBaseline(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := p.checkBaselineStore(); err != nil {
+		writeError(w, err)
+		return
+	}
+	namespace, rollout, revision, err := baselineKey(ps)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := p.baselines.get(namespace, rollout, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if b == nil {
+		writeError(w, newStatusError(http.StatusNotFound, "no baseline for %s/%s revision %s", namespace, rollout, revision))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// baselineComparison is the response of the compare endpoint.
+type baselineComparison struct {
+	Baseline trafficSnapshot `json:"baseline"`
+	Current  trafficSnapshot `json:"current"`
+	// ErrorRateIncrease is the current error rate minus the baseline error rate.
+	ErrorRateIncrease float64 `json:"error_rate_increase"`
+	// Latency ratios are current over baseline latency. They are 1 without baseline latency.
+	LatencyP50Ratio float64 `json:"latency_p50_ratio"`
+	LatencyP90Ratio float64 `json:"latency_p90_ratio"`
+	LatencyP99Ratio float64 `json:"latency_p99_ratio"`
+	// MixShift is the total variation distance between the baseline and current endpoint mix:
+	// 0 for the same mix, 1 for no endpoints in common.
+	MixShift float64 `json:"mix_shift"`
+	// Regressed is true if any of the above exceeds its threshold. Reasons lists which.
+	Regressed bool     `json:"regressed"`
+	Reasons   []string `json:"reasons"`
+}
+
+// regressionThresholds are read from the `max_error_rate_increase`, `max_latency_ratio` and
+// `max_mix_shift` query parameters.
+type regressionThresholds struct {
+	maxErrorRateIncrease float64
+	maxLatencyRatio      float64
+	maxMixShift          float64
+}
+
+func parseRegressionThresholds(query url.Values) (regressionThresholds, error) {
+	t := regressionThresholds{
+		maxErrorRateIncrease: defaultMaxErrorRateIncrease,
+		maxLatencyRatio:      defaultMaxLatencyRatio,
+		maxMixShift:          defaultMaxMixShift,
+	}
+	for name, dst := range map[string]*float64{
+		"max_error_rate_increase": &t.maxErrorRateIncrease,
+		"max_latency_ratio":       &t.maxLatencyRatio,
+		"max_mix_shift":           &t.maxMixShift,
+	} {
+		s := query.Get(name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return t, fmt.Errorf("invalid %s %q", name, s)
+		}
+		*dst = v
+	}
+	return t, nil
+}
+
+func latencyRatio(current, base float64) float64 {
+	if base <= 0 {
+		return 1
+	}
+	return current / base
+}
+
+// endpointMixShift returns the total variation distance between two endpoint mixes.
+func endpointMixShift(base, current []endpointStats) float64 {
+	shares := make(map[string][2]float64)
+	for _, e := range base {
+		s := shares[e.Method+" "+e.Path]
+		s[0] = e.Share
+		shares[e.Method+" "+e.Path] = s
+	}
+	for _, e := range current {
+		s := shares[e.Method+" "+e.Path]
+		s[1] = e.Share
+		shares[e.Method+" "+e.Path] = s
+	}
+	var shift float64
+	for _, s := range shares {
+		shift += math.Abs(s[0] - s[1])
+	}
+	return shift / 2
+}
+
+func compareToBaseline(base, current trafficSnapshot, t regressionThresholds) baselineComparison {
+	c := baselineComparison{
+		Baseline:          base,
+		Current:           current,
+		ErrorRateIncrease: current.ErrorRate - base.ErrorRate,
+		LatencyP50Ratio:   latencyRatio(current.LatencyP50Ms, base.LatencyP50Ms),
+		LatencyP90Ratio:   latencyRatio(current.LatencyP90Ms, base.LatencyP90Ms),
+		LatencyP99Ratio:   latencyRatio(current.LatencyP99Ms, base.LatencyP99Ms),
+		Reasons:           []string{},
+	}
+	// Without traffic on either side there is no mix to compare.
+	if base.Requests > 0 && current.Requests > 0 {
+		c.MixShift = endpointMixShift(base.Endpoints, current.Endpoints)
+	}
+
+	if c.ErrorRateIncrease > t.maxErrorRateIncrease {
+		c.Reasons = append(c.Reasons, fmt.Sprintf("error rate increased by %.4f (max %.4f)", c.ErrorRateIncrease, t.maxErrorRateIncrease))
+	}
+	for _, r := range []struct {
+		name  string
+		ratio float64
+	}{{"p50", c.LatencyP50Ratio}, {"p90", c.LatencyP90Ratio}, {"p99", c.LatencyP99Ratio}} {
+		if r.ratio > t.maxLatencyRatio {
+			c.Reasons = append(c.Reasons, fmt.Sprintf("%s latency is %.2fx the baseline (max %.2fx)", r.name, r.ratio, t.maxLatencyRatio))
+		}
+	}
+	if c.MixShift > t.maxMixShift {
+		c.Reasons = append(c.Reasons, fmt.Sprintf("endpoint mix shifted by %.2f (max %.2f)", c.MixShift, t.maxMixShift))
+	}
+	c.Regressed = len(c.Reasons) > 0
+	return c
+}
+
+// compareBaseline measures the target pods and compares them against the stored baseline of a
+// rollout revision.
+func (p *pixieMetricsProvider) compareBaseline(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := p.checkBaselineStore(); err != nil {
+		writeError(w, err)
+		return
+	}
+	namespace, rollout, revision, err := baselineKey(ps)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	classifier, err := parseErrorClassifier(req.URL.Query())
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	window, err := parseWindow(req.URL.Query(), defaultCompareWindow)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	thresholds, err := parseRegressionThresholds(req.URL.Query())
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	b, err := p.baselines.get(namespace, rollout, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if b == nil {
+		writeError(w, newStatusError(http.StatusNotFound, "no baseline for %s/%s revision %s", namespace, rollout, revision))
+		return
+	}
+	target, err := p.queryTarget(req, ps)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	e := newEvaluation(evaluationCompare, target, buildBaselineScript(target, classifier, window))
+	e.Revision = revision
+	ctx, cancel := p.queryContext(req)
+	defer cancel()
+	current, err := p.snapshot(ctx, target, classifier, window)
+	if err != nil {
+		p.recordEvaluation(req, ps, e, nil, err)
+		writeError(w, queryError(ctx, err))
+		return
+	}
+	c := compareToBaseline(b.Stats, current, thresholds)
+	p.recordEvaluation(req, ps, e, c, nil)
+	log.Printf("Compared %s against the %s/%s revision %s baseline: regressed=%t %v\n",
+		target, namespace, rollout, revision, c.Regressed, c.Reasons)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func defaultThresholds() regressionThresholds {
+	return regressionThresholds{
+		maxErrorRateIncrease: defaultMaxErrorRateIncrease,
+		maxLatencyRatio:      defaultMaxLatencyRatio,
+		maxMixShift:          defaultMaxMixShift,
+	}
+}
+
+// baselineTraffic is the traffic of the stable revision the canaries are compared against.
+func baselineTraffic() trafficSnapshot {
+	return trafficSnapshot{
+		Requests:     1000,
+		ErrorRate:    0.01,
+		LatencyP50Ms: 10,
+		LatencyP90Ms: 40,
+		LatencyP99Ms: 100,
+		Endpoints: []endpointStats{
+			{Method: "GET", Path: "/carts/{id}", Share: 0.7},
+			{Method: "POST", Path: "/carts/{id}/items", Share: 0.3},
+		},
+	}
+}
+
+func TestEndpointMixShift(t *testing.T) {
+	tests := []struct {
+		name          string
+		base, current []endpointStats
+		want          float64
+	}{
+		{
+			name:    "same mix",
+			base:    baselineTraffic().Endpoints,
+			current: baselineTraffic().Endpoints,
+			want:    0,
+		},
+		{
+			name:    "shifted",
+			base:    baselineTraffic().Endpoints,
+			current: []endpointStats{{Method: "GET", Path: "/carts/{id}", Share: 0.4}, {Method: "POST", Path: "/carts/{id}/items", Share: 0.6}},
+			want:    0.3,
+		},
+		{
+			name:    "disjoint",
+			base:    baselineTraffic().Endpoints,
+			current: []endpointStats{{Method: "GET", Path: "/health", Share: 1}},
+			want:    1,
+		},
+		{
+			name:    "method matters",
+			base:    []endpointStats{{Method: "GET", Path: "/carts", Share: 1}},
+			current: []endpointStats{{Method: "POST", Path: "/carts", Share: 1}},
+			want:    1,
+		},
+		{name: "both empty", want: 0},
+		{
+			name:    "empty baseline",
+			current: baselineTraffic().Endpoints,
+			want:    0.5,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := endpointMixShift(tc.base, tc.current); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("endpointMixShift() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompareToBaseline(t *testing.T) {
+	tests := []struct {
+		name        string
+		base        trafficSnapshot
+		current     func(s *trafficSnapshot)
+		thresholds  func(t *regressionThresholds)
+		wantReasons []string
+		wantShift   float64
+	}{
+		{
+			name:    "same traffic",
+			base:    baselineTraffic(),
+			current: func(s *trafficSnapshot) {},
+		},
+		{
+			name:        "error rate",
+			base:        baselineTraffic(),
+			current:     func(s *trafficSnapshot) { s.ErrorRate = 0.05 },
+			wantReasons: []string{"error rate increased by 0.0400 (max 0.0100)"},
+		},
+		{
+			name:    "error rate within threshold",
+			base:    baselineTraffic(),
+			current: func(s *trafficSnapshot) { s.ErrorRate = 0.015 },
+		},
+		{
+			name:    "lower error rate",
+			base:    baselineTraffic(),
+			current: func(s *trafficSnapshot) { s.ErrorRate = 0 },
+		},
+		{
+			name:    "latency",
+			base:    baselineTraffic(),
+			current: func(s *trafficSnapshot) { s.LatencyP90Ms, s.LatencyP99Ms = 80, 300 },
+			wantReasons: []string{
+				"p90 latency is 2.00x the baseline (max 1.50x)",
+				"p99 latency is 3.00x the baseline (max 1.50x)",
+			},
+		},
+		{
+			name: "mix shift",
+			base: baselineTraffic(),
+			current: func(s *trafficSnapshot) {
+				s.Endpoints = []endpointStats{{Method: "GET", Path: "/carts/{id}", Share: 0.4}, {Method: "POST", Path: "/carts/{id}/items", Share: 0.6}}
+			},
+			wantReasons: []string{"endpoint mix shifted by 0.30 (max 0.20)"},
+			wantShift:   0.3,
+		},
+		{
+			name: "custom thresholds",
+			base: baselineTraffic(),
+			current: func(s *trafficSnapshot) {
+				s.ErrorRate = 0.05
+				s.Endpoints = []endpointStats{{Method: "GET", Path: "/carts/{id}", Share: 0.4}, {Method: "POST", Path: "/carts/{id}/items", Share: 0.6}}
+			},
+			thresholds: func(t *regressionThresholds) { t.maxErrorRateIncrease, t.maxMixShift = 0.1, 0.5 },
+			wantShift:  0.3,
+		},
+		{
+			name:    "empty baseline",
+			base:    trafficSnapshot{Endpoints: []endpointStats{}},
+			current: func(s *trafficSnapshot) {},
+			// Without baseline latency the ratios are 1, and without baseline traffic there
+			// is no mix to compare, so only the error rate is checked.
+			wantReasons: nil,
+		},
+		{
+			name: "empty baseline with errors",
+			base: trafficSnapshot{Endpoints: []endpointStats{}},
+			current: func(s *trafficSnapshot) {
+				s.ErrorRate = 0.5
+			},
+			wantReasons: []string{"error rate increased by 0.5000 (max 0.0100)"},
+		},
+		{
+			name: "canary without traffic",
+			base: baselineTraffic(),
+			current: func(s *trafficSnapshot) {
+				*s = trafficSnapshot{Endpoints: []endpointStats{}}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			current := baselineTraffic()
+			tc.current(&current)
+			thresholds := defaultThresholds()
+			if tc.thresholds != nil {
+				tc.thresholds(&thresholds)
+			}
+			c := compareToBaseline(tc.base, current, thresholds)
+			if c.Reasons == nil {
+				t.Error("Reasons is nil, want an empty list in the JSON")
+			}
+			if len(c.Reasons) != len(tc.wantReasons) || (len(c.Reasons) > 0 && !reflect.DeepEqual(c.Reasons, tc.wantReasons)) {
+				t.Errorf("Reasons = %q, want %q", c.Reasons, tc.wantReasons)
+			}
+			if c.Regressed != (len(tc.wantReasons) > 0) {
+				t.Errorf("Regressed = %t, want %t", c.Regressed, len(tc.wantReasons) > 0)
+			}
+			if math.Abs(c.MixShift-tc.wantShift) > 1e-9 {
+				t.Errorf("MixShift = %v, want %v", c.MixShift, tc.wantShift)
+			}
+			for _, ratio := range []float64{c.LatencyP50Ratio, c.LatencyP90Ratio, c.LatencyP99Ratio} {
+				if math.IsNaN(ratio) || math.IsInf(ratio, 0) {
+					t.Errorf("latency ratio = %v, want a finite number", ratio)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareToStoredBaseline(t *testing.T) {
+	store, err := newBaselineStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := store.get("default", "carts", "5f7d9c8b6"); err != nil || b != nil {
+		t.Fatalf("get() of a missing baseline = %v, %v, want nil", b, err)
+	}
+	stored := &baseline{
+		Namespace:  "default",
+		Rollout:    "carts",
+		Revision:   "5f7d9c8b6",
+		Pods:       "default/app=carts",
+		CapturedAt: time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC),
+		Window:     "5m0s",
+		Stats:      baselineTraffic(),
+	}
+	if err := store.put(stored); err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.get("default", "carts", "5f7d9c8b6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, stored) {
+		t.Fatalf("get() = %+v, want %+v", b, stored)
+	}
+
+	canary := baselineTraffic()
+	canary.ErrorRate = 0.2
+	c := compareToBaseline(b.Stats, canary, defaultThresholds())
+	if !c.Regressed || len(c.Reasons) != 1 || !strings.HasPrefix(c.Reasons[0], "error rate increased") {
+		t.Errorf("comparison = %+v, want an error rate regression", c)
+	}
+}
+
+func TestSnapshotFinish(t *testing.T) {
+	s := &snapshotMux{window: 10 * time.Second}
+	s.snapshot.Requests = 40
+	s.errors = 4
+	s.snapshot.Endpoints = []endpointStats{
+		{Method: "GET", Path: "/orders/{id}", RPS: 10},
+		{Method: "POST", Path: "/carts", RPS: 10},
+		{Method: "GET", Path: "/carts", RPS: 10},
+		{Method: "GET", Path: "/health", RPS: 5},
+		{Method: "DELETE", Path: "/carts", RPS: 5},
+	}
+	s.finish()
+	got := s.result()
+	want := []endpointStats{
+		{Method: "GET", Path: "/carts", RPS: 1, Share: 0.25},
+		{Method: "POST", Path: "/carts", RPS: 1, Share: 0.25},
+		{Method: "GET", Path: "/orders/{id}", RPS: 1, Share: 0.25},
+		{Method: "DELETE", Path: "/carts", RPS: 0.5, Share: 0.125},
+		{Method: "GET", Path: "/health", RPS: 0.5, Share: 0.125},
+	}
+	if !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("Endpoints = %+v, want %+v", got.Endpoints, want)
+	}
+	if got.ErrorRate != 0.1 {
+		t.Errorf("ErrorRate = %v, want 0.1", got.ErrorRate)
+	}
+
+	empty := (&snapshotMux{window: 10 * time.Second}).result()
+	if empty.ErrorRate != 0 || empty.Endpoints == nil || len(empty.Endpoints) != 0 {
+		t.Errorf("snapshot without traffic = %+v, want no error rate and no endpoints", empty)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Error classification modes, selected with the `classify` query parameter.
+const (
+	// classifyHTTP counts responses with an HTTP status >= 400 as errors.
+	classifyHTTP = "http"
+	// classifyGRPC additionally counts responses whose `grpc-status` trailer is one of the
+	// failing gRPC status codes. gRPC services report errors with an HTTP 200 status.
+	classifyGRPC = "grpc"
+)
+
+// gRPC status codes by their canonical names.
+var grpcCodesByName = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+const maxGRPCCode = 16
+
+// errorClassifier decides which traced requests count as failures.
+type errorClassifier struct {
+	mode string
+	// grpcCodes are the gRPC status codes counted as failures. Empty means any non-zero code.
+	grpcCodes []int
+}
+
+// parseErrorClassifier reads the classification from the `classify` and `grpc_codes` query
+// parameters, for example `?classify=grpc&grpc_codes=UNKNOWN,INTERNAL,14`.
+func parseErrorClassifier(query url.Values) (errorClassifier, error) {
+	c := errorClassifier{mode: query.Get("classify")}
+	if c.mode == "" {
+		c.mode = classifyHTTP
+	}
+	if c.mode != classifyHTTP && c.mode != classifyGRPC {
+		return c, fmt.Errorf("invalid classify mode %q: must be %q or %q", c.mode, classifyHTTP, classifyGRPC)
+	}
+
+	codes := query.Get("grpc_codes")
+	if codes == "" {
+		return c, nil
+	}
+	if c.mode != classifyGRPC {
+		return c, fmt.Errorf("grpc_codes requires classify=%s", classifyGRPC)
+	}
+	for _, name := range strings.Split(codes, ",") {
+		code, err := parseGRPCCode(strings.TrimSpace(name))
+		if err != nil {
+			return c, err
+		}
+		c.grpcCodes = append(c.grpcCodes, code)
+	}
+	return c, nil
+}
+
+func parseGRPCCode(s string) (int, error) {
+	if code, ok := grpcCodesByName[strings.ToUpper(s)]; ok {
+		return code, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 0 || code > maxGRPCCode {
+		return 0, fmt.Errorf("invalid gRPC status code %q", s)
+	}
+	return code, nil
+}
+
+// failureColumn returns the PxL statements that add the boolean `failure` column to df.
+func (c errorClassifier) failureColumn() string {
+	if c.mode != classifyGRPC {
+		return "df.failure = df.resp_status >= 400"
+	}
+
+	// The grpc-status trailer is traced along with the response headers. Requests without
+	// it, such as plain HTTP/1.1 traffic, are treated as OK.
+	conds := []string{"df.resp_status >= 400"}
+	if len(c.grpcCodes) == 0 {
+		conds = append(conds, "df.grpc_status != 0")
+	}
+	for _, code := range c.grpcCodes {
+		conds = append(conds, fmt.Sprintf("df.grpc_status == %d", code))
+	}
+	return "df.grpc_status = px.atoi(px.pluck(df.resp_headers, 'grpc-status'), 0)\n" +
+		"df.failure = " + strings.Join(conds, " or ")
+}
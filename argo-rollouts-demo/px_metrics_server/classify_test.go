@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseGRPCCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		code  int
+		valid bool
+	}{
+		{"name", "INTERNAL", 13, true},
+		{"lowercase name", "unavailable", 14, true},
+		{"mixed case name", "Deadline_Exceeded", 4, true},
+		{"ok", "OK", 0, true},
+		{"number", "14", 14, true},
+		{"zero", "0", 0, true},
+		{"max", "16", 16, true},
+		{"too large", "17", 0, false},
+		{"negative", "-1", 0, false},
+		{"unknown name", "TEAPOT", 0, false},
+		{"empty", "", 0, false},
+		{"http status", "503", 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := parseGRPCCode(tc.in)
+			if (err == nil) != tc.valid {
+				t.Fatalf("parseGRPCCode(%q) = %v, want valid=%v", tc.in, err, tc.valid)
+			}
+			if code != tc.code {
+				t.Errorf("parseGRPCCode(%q) = %d, want %d", tc.in, code, tc.code)
+			}
+		})
+	}
+}
+
+func TestParseErrorClassifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  errorClassifier
+		valid bool
+	}{
+		{"default", "", errorClassifier{mode: classifyHTTP}, true},
+		{"http", "classify=http", errorClassifier{mode: classifyHTTP}, true},
+		{"grpc", "classify=grpc", errorClassifier{mode: classifyGRPC}, true},
+		{"grpc codes", "classify=grpc&grpc_codes=UNKNOWN,INTERNAL,14",
+			errorClassifier{mode: classifyGRPC, grpcCodes: []int{2, 13, 14}}, true},
+		{"grpc codes with spaces", "classify=grpc&grpc_codes=unavailable,%20deadline_exceeded",
+			errorClassifier{mode: classifyGRPC, grpcCodes: []int{14, 4}}, true},
+		{"unknown mode", "classify=thrift", errorClassifier{}, false},
+		{"codes without grpc", "grpc_codes=INTERNAL", errorClassifier{}, false},
+		{"codes with http", "classify=http&grpc_codes=INTERNAL", errorClassifier{}, false},
+		{"bad code", "classify=grpc&grpc_codes=INTERNAL,TEAPOT", errorClassifier{}, false},
+		{"empty code", "classify=grpc&grpc_codes=INTERNAL,", errorClassifier{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := parseErrorClassifier(query)
+			if (err == nil) != tc.valid {
+				t.Fatalf("parseErrorClassifier(%q) = %v, want valid=%v", tc.query, err, tc.valid)
+			}
+			if tc.valid && !reflect.DeepEqual(c, tc.want) {
+				t.Errorf("parseErrorClassifier(%q) = %+v, want %+v", tc.query, c, tc.want)
+			}
+		})
+	}
+}
+
+func TestFailureColumn(t *testing.T) {
+	const pluckStatus = "df.grpc_status = px.atoi(px.pluck(df.resp_headers, 'grpc-status'), 0)\n"
+	tests := []struct {
+		name string
+		c    errorClassifier
+		want string
+	}{
+		{"http", errorClassifier{mode: classifyHTTP},
+			"df.failure = df.resp_status >= 400"},
+		{"grpc any code", errorClassifier{mode: classifyGRPC},
+			pluckStatus + "df.failure = df.resp_status >= 400 or df.grpc_status != 0"},
+		{"grpc one code", errorClassifier{mode: classifyGRPC, grpcCodes: []int{14}},
+			pluckStatus + "df.failure = df.resp_status >= 400 or df.grpc_status == 14"},
+		{"grpc codes", errorClassifier{mode: classifyGRPC, grpcCodes: []int{2, 13, 14}},
+			pluckStatus + "df.failure = df.resp_status >= 400 or df.grpc_status == 2 or df.grpc_status == 13 or df.grpc_status == 14"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.c.failureColumn(); got != tc.want {
+				t.Errorf("failureColumn() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
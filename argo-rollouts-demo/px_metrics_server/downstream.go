@@ -0,0 +1,238 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	"px.dev/pxapi"
+	pxTypes "px.dev/pxapi/types"
+)
+
+// PxL script computing the impact of the target pods on the services they call. The outbound
+// table is traced on the target pods (trace_role == 1) and shows what the canary sees. The
+// downstream table is traced on the called pods (trace_role == 2), restricted to requests made
+// by the target pods, and shows what the dependencies return to the canary.
+const downstreamPxlScript = `import px
+
+POD_NAMESPACE=%[1]s
+POD_NAME=%[2]s
+START_TIME=%[3]s
+
+def service_stats(df):
+    df = df.groupby('service').agg(
+        req_count=('latency', px.count),
+        error_count=('failure', px.sum),
+        latency=('latency', px.quantiles)
+    )
+    df.latency_p50 = px.pluck_float64(df.latency, 'p50')
+    df.latency_p99 = px.pluck_float64(df.latency, 'p99')
+    return df[['service', 'req_count', 'error_count', 'latency_p50', 'latency_p99']]
+
+# Outbound requests made by the target pods.
+df = px.DataFrame(table='http_events', start_time=START_TIME)
+df.namespace = df.ctx['namespace']
+df.pod = df.ctx['pod']
+df = df[df.trace_role == 1]
+df = df[df.namespace == POD_NAMESPACE]
+df = df[%[5]s]
+%[4]s
+df.service = px.pod_id_to_service_name(px.ip_to_pod_id(df.remote_addr))
+df.service = px.select(df.service != '', df.service, df.remote_addr)
+px.display(service_stats(df), 'outbound_stats')
+
+# Requests served by other pods to the target pods.
+df = px.DataFrame(table='http_events', start_time=START_TIME)
+df = df[df.trace_role == 2]
+df.requestor = px.pod_id_to_pod_name(px.ip_to_pod_id(df.remote_addr))
+df = df[%[6]s]
+%[4]s
+df.service = df.ctx['service']
+px.display(service_stats(df), 'downstream_stats')
+`
+
+const (
+	outboundStatsTable   = "outbound_stats"
+	downstreamStatsTable = "downstream_stats"
+)
+
+func buildDownstreamScript(t podTarget, c errorClassifier) string {
+	return fmt.Sprintf(downstreamPxlScript, pxlString(t.namespace), pxlString(t.name), pxlString(timeWindow),
+		c.failureColumn(), t.podFilter("df.pod"), t.podFilter("df.requestor"))
+}
+
+// serviceImpact holds the request stats between the target pods and one service.
+type serviceImpact struct {
+	Service      string  `json:"service"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP99Ms float64 `json:"latency_p99_ms"`
+}
+
+// downstreamImpact is the response of the downstream endpoints.
+type downstreamImpact struct {
+	// ErrorRate is the worst of the outbound and downstream error rates, so a single Argo
+	// successCondition covers both.
+	ErrorRate           float64 `json:"error_rate"`
+	OutboundErrorRate   float64 `json:"outbound_error_rate"`
+	DownstreamErrorRate float64 `json:"downstream_error_rate"`
+	// OutboundLatencyP99Ms is the highest p99 latency of the services the target pods call.
+	OutboundLatencyP99Ms float64         `json:"outbound_latency_p99_ms"`
+	Outbound             []serviceImpact `json:"outbound"`
+	Downstream           []serviceImpact `json:"downstream"`
+}
+
+func newDownstreamImpact(outbound, downstream []serviceImpact) downstreamImpact {
+	// Encode missing tables as empty lists rather than null.
+	if outbound == nil {
+		outbound = []serviceImpact{}
+	}
+	if downstream == nil {
+		downstream = []serviceImpact{}
+	}
+	impact := downstreamImpact{
+		Outbound:            outbound,
+		Downstream:          downstream,
+		OutboundErrorRate:   totalErrorRate(outbound),
+		DownstreamErrorRate: totalErrorRate(downstream),
+	}
+	for _, s := range outbound {
+		if s.LatencyP99Ms > impact.OutboundLatencyP99Ms {
+			impact.OutboundLatencyP99Ms = s.LatencyP99Ms
+		}
+	}
+	impact.ErrorRate = impact.OutboundErrorRate
+	if impact.DownstreamErrorRate > impact.ErrorRate {
+		impact.ErrorRate = impact.DownstreamErrorRate
+	}
+	return impact
+}
+
+func totalErrorRate(stats []serviceImpact) float64 {
+	var requests, errors int64
+	for _, s := range stats {
+		requests += s.Requests
+		errors += s.Errors
+	}
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
+
+// Implement the TableRecordHandler interface to collect the per-service stats tables.
+type serviceStatsCollector struct {
+	stats []serviceImpact
+}
+
+func (t *serviceStatsCollector) HandleInit(ctx context.Context, metadata pxTypes.TableMetadata) error {
+	return nil
+}
+
+func (t *serviceStatsCollector) HandleRecord(ctx context.Context, r *pxTypes.Record) error {
+	s := serviceImpact{Service: r.GetDatum("service").String()}
+	if v, ok := datumFloat(r.GetDatum("req_count")); ok {
+		s.Requests = int64(v)
+	}
+	if v, ok := datumFloat(r.GetDatum("error_count")); ok {
+		s.Errors = int64(v)
+	}
+	if s.Requests != 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	}
+	// Latencies are reported in nanoseconds.
+	if v, ok := datumFloat(r.GetDatum("latency_p50")); ok {
+		s.LatencyP50Ms = v / 1e6
+	}
+	if v, ok := datumFloat(r.GetDatum("latency_p99")); ok {
+		s.LatencyP99Ms = v / 1e6
+	}
+	t.stats = append(t.stats, s)
+	return nil
+}
+
+func (t *serviceStatsCollector) HandleDone(ctx context.Context) error {
+	// Worst services first.
+	sort.Slice(t.stats, func(i, j int) bool {
+		if t.stats[i].ErrorRate != t.stats[j].ErrorRate {
+			return t.stats[i].ErrorRate > t.stats[j].ErrorRate
+		}
+		return t.stats[i].Service < t.stats[j].Service
+	})
+	return nil
+}
+
+// Implement the TableMuxer to route the outbound and downstream tables to their collectors.
+type downstreamMux struct {
+	outbound   serviceStatsCollector
+	downstream serviceStatsCollector
+}
+
+func (s *downstreamMux) AcceptTable(ctx context.Context, metadata pxTypes.TableMetadata) (pxapi.TableRecordHandler, error) {
+	switch metadata.Name {
+	case outboundStatsTable:
+		return &s.outbound, nil
+	case downstreamStatsTable:
+		return &s.downstream, nil
+	}
+	return nil, fmt.Errorf("Table %s not found", metadata.Name)
+}
+
+// downstream returns the handler measuring how the pods found by resolve affect the services
+// they call.
+func (p *pixieMetricsProvider) downstream(resolve targetResolver) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		classifier, err := parseErrorClassifier(req.URL.Query())
+		if err != nil {
+			writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+			return
+		}
+		target, err := resolve(req, ps)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		tm := &downstreamMux{}
+		script := buildDownstreamScript(target, classifier)
+		e := newEvaluation(evaluationDownstream, target, script)
+		ctx, cancel := p.queryContext(req)
+		defer cancel()
+		if err := p.executeScript(ctx, script, tm); err != nil {
+			p.recordEvaluation(req, ps, e, nil, err)
+			writeError(w, queryError(ctx, err))
+			return
+		}
+		impact := newDownstreamImpact(tm.outbound.stats, tm.downstream.stats)
+		p.recordEvaluation(req, ps, e, impact, nil)
+		log.Printf("The %s pod(s) see a %2.2f %% outbound error rate and cause a %2.2f %% downstream error rate.\n",
+			target, impact.OutboundErrorRate*100, impact.DownstreamErrorRate*100)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(impact)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pxTypes "px.dev/pxapi/types"
+)
+
+// PxL statements added to the error rate script to break the filtered requests down by
+// endpoint. The paths are templated afterwards, see templatePath.
+const endpointBreakdownPxl = `
+endpoints = df.groupby(['req_method', 'req_path']).agg(
+    req_count=('latency', px.count),
+    error_count=('failure', px.sum)
+)
+px.display(endpoints, 'endpoint_errors')
+`
+
+const endpointErrorsTable = "endpoint_errors"
+
+// Placeholder replacing the path segments that look like identifiers.
+const pathIDPlaceholder = "{id}"
+
+var (
+	numericSegmentRegexp = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegmentRegexp    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegmentRegexp     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	// Long opaque tokens mixing letters and digits, such as base64 IDs.
+	tokenSegmentRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]{20,}$`)
+	digitRegexp        = regexp.MustCompile(`[0-9]`)
+)
+
+// templatePath strips the query string from a request path and replaces the segments that
+// look like identifiers with {id}, so that `/users/42?x=1` and `/users/43` are reported as the
+// single `/users/{id}` endpoint.
+func templatePath(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isIDSegment(s) {
+			segments[i] = pathIDPlaceholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIDSegment(s string) bool {
+	switch {
+	case numericSegmentRegexp.MatchString(s), uuidSegmentRegexp.MatchString(s):
+		return true
+	case hexSegmentRegexp.MatchString(s), tokenSegmentRegexp.MatchString(s):
+		// Don't collapse long words without digits, such as `configuration-settings`.
+		return digitRegexp.MatchString(s)
+	}
+	return false
+}
+
+// endpointErrors holds the request stats of one templated endpoint.
+type endpointErrors struct {
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// endpointBreakdown configures the optional per-endpoint stats of the error rate endpoints. It
+// is read from the `endpoints` and `min_requests` query parameters.
+type endpointBreakdown struct {
+	enabled bool
+	// minRequests is the number of requests an endpoint needs to be picked as the worst
+	// endpoint, so that a single failed request doesn't fail a rollout.
+	minRequests int64
+}
+
+func parseEndpointBreakdown(query url.Values) (endpointBreakdown, error) {
+	b := endpointBreakdown{minRequests: 1}
+	if s := query.Get("endpoints"); s != "" {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return b, fmt.Errorf("invalid endpoints %q: must be true or false", s)
+		}
+		b.enabled = enabled
+	}
+	if s := query.Get("min_requests"); s != "" {
+		if !b.enabled {
+			return b, fmt.Errorf("min_requests requires endpoints=true")
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return b, fmt.Errorf("invalid min_requests %q: must be a positive integer", s)
+		}
+		b.minRequests = n
+	}
+	return b, nil
+}
+
+// pxl returns the PxL statements to add to the error rate script.
+func (b endpointBreakdown) pxl() string {
+	if !b.enabled {
+		return ""
+	}
+	return endpointBreakdownPxl
+}
+
+// Implement the TableRecordHandler interface to collect the endpoint stats, merging the paths
+// that share a template.
+type endpointErrorsCollector struct {
+	byEndpoint map[string]*endpointErrors
+}
+
+func (t *endpointErrorsCollector) HandleInit(ctx context.Context, metadata pxTypes.TableMetadata) error {
+	t.byEndpoint = make(map[string]*endpointErrors)
+	return nil
+}
+
+func (t *endpointErrorsCollector) HandleRecord(ctx context.Context, r *pxTypes.Record) error {
+	method := r.GetDatum("req_method").String()
+	path := templatePath(r.GetDatum("req_path").String())
+	key := method + " " + path
+	e, ok := t.byEndpoint[key]
+	if !ok {
+		e = &endpointErrors{Method: method, Path: path}
+		t.byEndpoint[key] = e
+	}
+	if v, ok := datumFloat(r.GetDatum("req_count")); ok {
+		e.Requests += int64(v)
+	}
+	if v, ok := datumFloat(r.GetDatum("error_count")); ok {
+		e.Errors += int64(v)
+	}
+	return nil
+}
+
+func (t *endpointErrorsCollector) HandleDone(ctx context.Context) error {
+	return nil
+}
+
+// stats returns the endpoint stats, worst endpoints first.
+func (t *endpointErrorsCollector) stats() []endpointErrors {
+	stats := []endpointErrors{}
+	for _, e := range t.byEndpoint {
+		if e.Requests != 0 {
+			e.ErrorRate = float64(e.Errors) / float64(e.Requests)
+		}
+		stats = append(stats, *e)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ErrorRate != stats[j].ErrorRate {
+			return stats[i].ErrorRate > stats[j].ErrorRate
+		}
+		if stats[i].Path != stats[j].Path {
+			return stats[i].Path < stats[j].Path
+		}
+		return stats[i].Method < stats[j].Method
+	})
+	return stats
+}
+
+// worstEndpoint returns the endpoint with the highest error rate among those with at least
+// minRequests requests, or nil if there is none.
+func worstEndpoint(stats []endpointErrors, minRequests int64) *endpointErrors {
+	for i := range stats {
+		if stats[i].Requests >= minRequests {
+			return &stats[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Flagger names the primary Deployment of a canary after its target Deployment.
+const flaggerPrimarySuffix = "-primary"
+
+// Workloads of a Flagger canary.
+const (
+	flaggerCanary  = "canary"
+	flaggerPrimary = "primary"
+)
+
+// Default window of the Flagger metrics, matching Flagger's default analysis interval.
+const defaultFlaggerWindow = time.Minute
+
+// Default maximum canary error rate of the Flagger webhook.
+const defaultFlaggerMaxErrorRate = 0.05
+
+// Flagger webhook types that gate the rollout on the canary metrics. The others, such as
+// `event` or `post-rollout`, are acknowledged without running a query.
+var flaggerGatingHooks = map[string]bool{
+	"rollout":                  true,
+	"confirm-traffic-increase": true,
+	"confirm-promotion":        true,
+}
+
+// Kinds of recorded Flagger evaluations.
+const (
+	evaluationFlaggerWebhook = "flagger-webhook"
+	evaluationFlaggerQuery   = "flagger-query"
+)
+
+// flaggerWorkloadTarget returns the pods of the canary or primary Deployment of a Flagger
+// canary targeting the given Deployment.
+func (p *pixieMetricsProvider) flaggerWorkloadTarget(req *http.Request, namespace, deployment, workload string) (podTarget, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	switch workload {
+	case flaggerCanary:
+	case flaggerPrimary:
+		deployment += flaggerPrimarySuffix
+	default:
+		return podTarget{}, newStatusError(http.StatusBadRequest, "invalid workload %q: must be %q or %q", workload, flaggerCanary, flaggerPrimary)
+	}
+	if err := validateServiceName(deployment); err != nil {
+		return podTarget{}, newStatusError(http.StatusBadRequest, "invalid deployment name %q", deployment)
+	}
+	if p.kubeClient == nil {
+		return podTarget{}, newStatusError(http.StatusServiceUnavailable, "Kubernetes API is not available")
+	}
+	selector, err := p.kubeClient.deploymentSelector(req.Context(), namespace, deployment)
+	if err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadGateway, err: err}
+	}
+	return p.podSetTarget(req, namespace, formatLabelSelector(selector))
+}
+
+// flaggerWebhookPayload is the body of the requests Flagger sends to webhooks.
+type flaggerWebhookPayload struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Phase     string            `json:"phase"`
+	Checksum  string            `json:"checksum"`
+	Type      string            `json:"type"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// flaggerVerdict is the response of the Flagger webhook.
+type flaggerVerdict struct {
+	Passed    bool   `json:"passed"`
+	Evaluated bool   `json:"evaluated"`
+	Canary    string `json:"canary,omitempty"`
+	// CanaryStats and PrimaryStats are the traffic of the canary and primary pods. The primary
+	// is only measured with `compare_primary`.
+	CanaryStats  *trafficSnapshot    `json:"canary_stats,omitempty"`
+	PrimaryStats *trafficSnapshot    `json:"primary_stats,omitempty"`
+	Comparison   *baselineComparison `json:"comparison,omitempty"`
+	Reasons      []string            `json:"reasons"`
+}
+
+// Largest webhook payload accepted.
+const maxFlaggerPayloadBytes = 1 << 20
+
+// flaggerWebhook implements a Flagger rollout webhook. It measures the canary pods and fails
+// the check with a 412 when they exceed the thresholds set in the webhook metadata:
+//
+//	metadata:
+//	  max_error_rate: "0.05"
+//	  max_latency_p99_ms: "500"
+//	  window: 1m
+//	  compare_primary: "true"
+//
+// `target` overrides the target Deployment, which defaults to the canary name. `classify` and
+// `grpc_codes` select the error classification, and with `compare_primary` the canary is also
+// compared against the primary pods using the thresholds of the compare endpoint.
+func (p *pixieMetricsProvider) flaggerWebhook(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var payload flaggerWebhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxFlaggerPayloadBytes)).Decode(&payload); err != nil {
+		writeError(w, newStatusError(http.StatusBadRequest, "invalid Flagger webhook payload: %s", err.Error()))
+		return
+	}
+	if !flaggerGatingHooks[payload.Type] {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flaggerVerdict{Passed: true, Reasons: []string{}})
+		return
+	}
+
+	// The metadata holds the same settings as the query parameters of the other endpoints.
+	params := url.Values{}
+	for k, v := range payload.Metadata {
+		params.Set(k, v)
+	}
+	target := params.Get("target")
+	if target == "" {
+		target = payload.Name
+	}
+	classifier, err := parseErrorClassifier(params)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	window, err := parseWindow(params, defaultFlaggerWindow)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	maxErrorRate, err := parseFloatParam(params, "max_error_rate", defaultFlaggerMaxErrorRate)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	maxLatencyP99, err := parseFloatParam(params, "max_latency_p99_ms", 0)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	comparePrimary := params.Get("compare_primary") == "true"
+	thresholds, err := parseRegressionThresholds(params)
+	if err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+
+	canary, err := p.flaggerWorkloadTarget(req, payload.Namespace, target, flaggerCanary)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ps := httprouter.Params{{Key: "namespace", Value: payload.Namespace}, {Key: "rollout", Value: payload.Name}}
+	e := newEvaluation(evaluationFlaggerWebhook, canary, buildBaselineScript(canary, classifier, window))
+	e.Revision = payload.Checksum
+
+	ctx, cancel := p.queryContext(req)
+	defer cancel()
+	canaryStats, err := p.snapshot(ctx, canary, classifier, window)
+	if err != nil {
+		p.recordEvaluation(req, ps, e, nil, err)
+		writeError(w, queryError(ctx, err))
+		return
+	}
+	verdict := flaggerVerdict{Evaluated: true, Canary: canary.String(), CanaryStats: &canaryStats, Reasons: []string{}}
+	if canaryStats.ErrorRate > maxErrorRate {
+		verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("error rate is %.4f (max %.4f)", canaryStats.ErrorRate, maxErrorRate))
+	}
+	if maxLatencyP99 > 0 && canaryStats.LatencyP99Ms > maxLatencyP99 {
+		verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("p99 latency is %.1f ms (max %.1f ms)", canaryStats.LatencyP99Ms, maxLatencyP99))
+	}
+	if comparePrimary {
+		primary, err := p.flaggerWorkloadTarget(req, payload.Namespace, target, flaggerPrimary)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		primaryStats, err := p.snapshot(ctx, primary, classifier, window)
+		if err != nil {
+			p.recordEvaluation(req, ps, e, nil, err)
+			writeError(w, queryError(ctx, err))
+			return
+		}
+		c := compareToBaseline(primaryStats, canaryStats, thresholds)
+		verdict.PrimaryStats, verdict.Comparison = &primaryStats, &c
+		verdict.Reasons = append(verdict.Reasons, c.Reasons...)
+	}
+	verdict.Passed = len(verdict.Reasons) == 0
+	p.recordEvaluation(req, ps, e, verdict, nil)
+	log.Printf("Flagger %s check of %s/%s: passed=%t %v\n", payload.Type, payload.Namespace, payload.Name, verdict.Passed, verdict.Reasons)
+
+	w.Header().Set("Content-Type", "application/json")
+	// Flagger fails the check on any non-2xx status.
+	if !verdict.Passed {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}
+	json.NewEncoder(w).Encode(verdict)
+}
+
+// parseFloatParam reads a non-negative number parameter.
+func parseFloatParam(params url.Values, name string, def float64) (float64, error) {
+	s := params.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative number", name, s)
+	}
+	return v, nil
+}
+
+// Metrics served to Flagger MetricTemplates, computed from the traffic snapshot of a workload.
+var flaggerMetrics = map[string]func(s trafficSnapshot, window time.Duration) float64{
+	"error_rate":     func(s trafficSnapshot, _ time.Duration) float64 { return s.ErrorRate },
+	"latency_p50_ms": func(s trafficSnapshot, _ time.Duration) float64 { return s.LatencyP50Ms },
+	"latency_p90_ms": func(s trafficSnapshot, _ time.Duration) float64 { return s.LatencyP90Ms },
+	"latency_p99_ms": func(s trafficSnapshot, _ time.Duration) float64 { return s.LatencyP99Ms },
+	"request_rate": func(s trafficSnapshot, window time.Duration) float64 {
+		return float64(s.Requests) / window.Seconds()
+	},
+}
+
+var (
+	flaggerQueryRegexp = regexp.MustCompile(`^\s*([a-z0-9_]+)\s*\{(.*)\}\s*$`)
+	flaggerLabelRegexp = regexp.MustCompile(`^\s*([a-z_]+)\s*=\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+)
+
+// flaggerQuery is a metric selector in PromQL syntax, such as
+// `error_rate{namespace="test", target="podinfo", interval="1m"}`.
+type flaggerQuery struct {
+	metric string
+	labels url.Values
+}
+
+func parseFlaggerQuery(q string) (flaggerQuery, error) {
+	m := flaggerQueryRegexp.FindStringSubmatch(q)
+	if m == nil {
+		return flaggerQuery{}, fmt.Errorf("invalid query %q: must be a selector such as error_rate{namespace=\"...\", target=\"...\"}", q)
+	}
+	if _, ok := flaggerMetrics[m[1]]; !ok {
+		return flaggerQuery{}, fmt.Errorf("unknown metric %q", m[1])
+	}
+	fq := flaggerQuery{metric: m[1], labels: url.Values{}}
+	rest := m[2]
+	for strings.TrimSpace(rest) != "" {
+		l := flaggerLabelRegexp.FindStringSubmatch(rest)
+		if l == nil {
+			return flaggerQuery{}, fmt.Errorf("invalid label matchers in query %q", q)
+		}
+		value, err := strconv.Unquote(`"` + l[2] + `"`)
+		if err != nil {
+			return flaggerQuery{}, fmt.Errorf("invalid label value %q in query %q", l[2], q)
+		}
+		fq.labels.Set(l[1], value)
+		rest = rest[len(l[0]):]
+	}
+	return fq, nil
+}
+
+// Prometheus HTTP API responses, as read by Flagger's Prometheus metrics provider.
+type promResponse struct {
+	Status    string    `json:"status"`
+	Data      *promData `json:"data,omitempty"`
+	ErrorType string    `json:"errorType,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type promData struct {
+	ResultType string       `json:"resultType"`
+	Result     []promSample `json:"result"`
+}
+
+type promSample struct {
+	Metric map[string]string `json:"metric"`
+	// Value is the [<unix time>, "<value>"] pair.
+	Value [2]interface{} `json:"value"`
+}
+
+func writePromValue(w http.ResponseWriter, metric map[string]string, v float64) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(promResponse{
+		Status: "success",
+		Data: &promData{
+			ResultType: "vector",
+			Result: []promSample{{
+				Metric: metric,
+				Value:  [2]interface{}{float64(time.Now().UnixNano()) / 1e9, strconv.FormatFloat(v, 'f', -1, 64)},
+			}},
+		},
+	})
+}
+
+func writePromError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	errorType := "internal"
+	var se *statusError
+	if errors.As(err, &se) {
+		status = se.status
+	}
+	switch {
+	case status == http.StatusBadRequest:
+		errorType = "bad_data"
+	case status == http.StatusGatewayTimeout:
+		errorType = "timeout"
+	case status >= 400 && status < 500:
+		errorType = "execution"
+	}
+	log.Printf("Request failed (%d): %s\n", status, err.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// flaggerQueryHandler implements the query endpoint of the Prometheus HTTP API, so that Flagger
+// MetricTemplates can use the server as a Prometheus provider. Queries select a metric for
+// the canary (default) or primary pods of a target Deployment:
+//
+//	error_rate{namespace="{{ namespace }}", target="{{ target }}", interval="{{ interval }}"}
+//
+// The `workload`, `classify` and `grpc_codes` labels are optional. `vector(1)`, which Flagger
+// uses to check that the provider is up, returns 1.
+func (p *pixieMetricsProvider) flaggerQueryHandler(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		writePromError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	q := req.Form.Get("query")
+	if strings.TrimSpace(q) == "vector(1)" {
+		writePromValue(w, map[string]string{}, 1)
+		return
+	}
+	fq, err := parseFlaggerQuery(q)
+	if err != nil {
+		writePromError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	classifier, err := parseErrorClassifier(fq.labels)
+	if err != nil {
+		writePromError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	window, err := parseWindow(url.Values{"window": {fq.labels.Get("interval")}}, defaultFlaggerWindow)
+	if err != nil {
+		writePromError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	workload := fq.labels.Get("workload")
+	if workload == "" {
+		workload = flaggerCanary
+	}
+	namespace, deployment := fq.labels.Get("namespace"), fq.labels.Get("target")
+	target, err := p.flaggerWorkloadTarget(req, namespace, deployment, workload)
+	if err != nil {
+		writePromError(w, err)
+		return
+	}
+
+	ps := httprouter.Params{{Key: "namespace", Value: namespace}, {Key: "rollout", Value: deployment}}
+	e := newEvaluation(evaluationFlaggerQuery, target, buildBaselineScript(target, classifier, window))
+	ctx, cancel := p.queryContext(req)
+	defer cancel()
+	stats, err := p.snapshot(ctx, target, classifier, window)
+	if err != nil {
+		p.recordEvaluation(req, ps, e, nil, err)
+		writePromError(w, queryError(ctx, err))
+		return
+	}
+	v := flaggerMetrics[fq.metric](stats, window)
+	p.recordEvaluation(req, ps, e, map[string]interface{}{fq.metric: v, "workload": workload}, nil)
+	log.Printf("Flagger query %s for the %s pod(s) returned %g.\n", fq.metric, target, v)
+	writePromValue(w, map[string]string{"__name__": fq.metric, "namespace": namespace, "target": deployment, "workload": workload}, v)
+}
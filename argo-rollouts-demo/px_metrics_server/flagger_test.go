@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFlaggerQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantMetric string
+		wantLabels url.Values
+		wantErr    string
+	}{
+		{
+			name:       "Flagger template",
+			query:      `error_rate{namespace="test", target="podinfo", interval="1m"}`,
+			wantMetric: "error_rate",
+			wantLabels: url.Values{"namespace": {"test"}, "target": {"podinfo"}, "interval": {"1m"}},
+		},
+		{
+			name:       "no spaces",
+			query:      `latency_p99_ms{namespace="test",target="podinfo",workload="primary"}`,
+			wantMetric: "latency_p99_ms",
+			wantLabels: url.Values{"namespace": {"test"}, "target": {"podinfo"}, "workload": {"primary"}},
+		},
+		{
+			name:       "trailing comma",
+			query:      `request_rate{namespace="test", target="podinfo",}`,
+			wantMetric: "request_rate",
+			wantLabels: url.Values{"namespace": {"test"}, "target": {"podinfo"}},
+		},
+		{
+			name:       "escaped quote",
+			query:      `error_rate{target="a\"b"}`,
+			wantMetric: "error_rate",
+			wantLabels: url.Values{"target": {`a"b`}},
+		},
+		{
+			name:       "no labels",
+			query:      `error_rate{}`,
+			wantMetric: "error_rate",
+			wantLabels: url.Values{},
+		},
+		{name: "unknown metric", query: `http_requests_total{namespace="test"}`, wantErr: `unknown metric "http_requests_total"`},
+		{name: "not a selector", query: `sum(rate(error_rate[1m]))`, wantErr: "invalid query"},
+		{name: "no braces", query: `error_rate`, wantErr: "invalid query"},
+		{name: "regexp matcher", query: `error_rate{target=~"pod.*"}`, wantErr: "invalid label matchers"},
+		{name: "negative matcher", query: `error_rate{target!="podinfo"}`, wantErr: "invalid label matchers"},
+		{name: "unquoted value", query: `error_rate{target=podinfo}`, wantErr: "invalid label matchers"},
+		{name: "missing comma", query: `error_rate{namespace="test" target="podinfo"}`, wantErr: "invalid label matchers"},
+		{name: "uppercase label", query: `error_rate{Target="podinfo"}`, wantErr: "invalid label matchers"},
+		{name: "invalid escape", query: `error_rate{target="a\qb"}`, wantErr: "invalid label value"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fq, err := parseFlaggerQuery(tc.query)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseFlaggerQuery(%q) = %+v, %v, want error %q", tc.query, fq, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fq.metric != tc.wantMetric {
+				t.Errorf("metric = %q, want %q", fq.metric, tc.wantMetric)
+			}
+			if !reflect.DeepEqual(fq.labels, tc.wantLabels) {
+				t.Errorf("labels = %v, want %v", fq.labels, tc.wantLabels)
+			}
+		})
+	}
+}
+
+func TestFlaggerQueryHandler(t *testing.T) {
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/api/v1/namespaces/test/pods": podList(map[string]string{"podinfo-a": "Pending"}),
+	})
+	tests := []struct {
+		name          string
+		kube          bool
+		query         string
+		wantStatus    int
+		wantErrorType string
+	}{
+		{name: "up check", query: "vector(1)", wantStatus: http.StatusOK},
+		{name: "unknown metric", query: `requests{namespace="test"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "bad matcher", query: `error_rate{target=~"pod.*"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "bad interval", query: `error_rate{namespace="test", target="podinfo", interval="1y"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "bad classify", query: `error_rate{namespace="test", target="podinfo", classify="tcp"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "bad workload", query: `error_rate{namespace="test", target="podinfo", workload="stable"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "bad namespace", query: `error_rate{namespace="Test", target="podinfo"}`, wantStatus: http.StatusBadRequest, wantErrorType: "bad_data"},
+		{name: "no Kubernetes API", query: `error_rate{namespace="test", target="podinfo"}`, wantStatus: http.StatusServiceUnavailable, wantErrorType: "internal"},
+		{name: "missing deployment", kube: true, query: `error_rate{namespace="test", target="podinfo"}`, wantStatus: http.StatusBadGateway, wantErrorType: "internal"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &pixieMetricsProvider{}
+			if tc.kube {
+				p.kubeClient = api.client()
+			}
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {tc.query}}.Encode(), nil)
+			w := httptest.NewRecorder()
+			p.flaggerQueryHandler(w, req, nil)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			var resp promResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantStatus == http.StatusOK {
+				if resp.Status != "success" || resp.Data == nil || len(resp.Data.Result) != 1 || resp.Data.Result[0].Value[1] != "1" {
+					t.Errorf("response = %+v, want the value 1", resp)
+				}
+				return
+			}
+			if resp.Status != "error" || resp.ErrorType != tc.wantErrorType {
+				t.Errorf("response = %+v, want an error of type %s", resp, tc.wantErrorType)
+			}
+		})
+	}
+}
+
+func TestFlaggerWebhookStatus(t *testing.T) {
+	deployment := map[string]interface{}{"spec": map[string]interface{}{"selector": map[string]interface{}{
+		"matchLabels": map[string]string{"app": "podinfo"},
+	}}}
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/apis/apps/v1/namespaces/test/deployments/podinfo": deployment,
+		"/api/v1/namespaces/test/pods":                      podList(map[string]string{"podinfo-a": "Pending"}),
+	})
+	tests := []struct {
+		name       string
+		kube       bool
+		body       string
+		wantStatus int
+		wantPassed bool
+	}{
+		{name: "invalid JSON", body: `{"name":`, wantStatus: http.StatusBadRequest},
+		{name: "event hook", body: `{"name":"podinfo","namespace":"test","type":"event"}`, wantStatus: http.StatusOK, wantPassed: true},
+		{name: "post-rollout hook", body: `{"name":"podinfo","namespace":"test","type":"post-rollout"}`, wantStatus: http.StatusOK, wantPassed: true},
+		{name: "invalid max_error_rate", body: `{"name":"podinfo","namespace":"test","type":"rollout","metadata":{"max_error_rate":"-1"}}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid latency", body: `{"name":"podinfo","namespace":"test","type":"rollout","metadata":{"max_latency_p99_ms":"fast"}}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid window", body: `{"name":"podinfo","namespace":"test","type":"rollout","metadata":{"window":"1y"}}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid classify", body: `{"name":"podinfo","namespace":"test","type":"rollout","metadata":{"classify":"tcp"}}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid threshold", body: `{"name":"podinfo","namespace":"test","type":"confirm-promotion","metadata":{"max_mix_shift":"NaN"}}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid namespace", body: `{"name":"podinfo","namespace":"Test","type":"rollout"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid target", body: `{"name":"podinfo","namespace":"test","type":"rollout","metadata":{"target":"pod info"}}`, wantStatus: http.StatusBadRequest},
+		{name: "no Kubernetes API", body: `{"name":"podinfo","namespace":"test","type":"rollout"}`, wantStatus: http.StatusServiceUnavailable},
+		{name: "missing deployment", kube: true, body: `{"name":"other","namespace":"test","type":"confirm-traffic-increase"}`, wantStatus: http.StatusBadGateway},
+		{name: "no running pods", kube: true, body: `{"name":"podinfo","namespace":"test","type":"rollout"}`, wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &pixieMetricsProvider{}
+			if tc.kube {
+				p.kubeClient = api.client()
+			}
+			req := httptest.NewRequest(http.MethodPost, "/flagger/webhook", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			p.flaggerWebhook(w, req, nil)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var verdict flaggerVerdict
+			if err := json.NewDecoder(w.Body).Decode(&verdict); err != nil {
+				t.Fatal(err)
+			}
+			if verdict.Passed != tc.wantPassed || verdict.Evaluated {
+				t.Errorf("verdict = %+v, want passed=%t without an evaluation", verdict, tc.wantPassed)
+			}
+		})
+	}
+}
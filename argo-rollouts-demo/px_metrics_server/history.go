@@ -0,0 +1,312 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Kinds of recorded evaluations, named after their endpoints.
+const (
+	evaluationErrorRate  = "error-rate"
+	evaluationDownstream = "downstream"
+	evaluationCompare    = "compare"
+)
+
+// evaluation is the record of one metric computed for a rollout.
+type evaluation struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Rollout   string `json:"rollout"`
+	// Revision is the `hash` query parameter or the compared baseline revision.
+	Revision   string          `json:"revision,omitempty"`
+	Request    string          `json:"request"`
+	Pods       string          `json:"pods"`
+	Query      string          `json:"query"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Duration returns how long the evaluation took, for the HTML report.
+func (e evaluation) Duration() time.Duration {
+	return e.FinishedAt.Sub(e.StartedAt).Round(time.Millisecond)
+}
+
+// Size over which the history file of a rollout is rotated. The previous file is kept, so a
+// rollout's history takes up to twice this size.
+const maxHistoryFileSize = 8 << 20
+
+// historyStore appends the evaluations of each rollout to a JSON lines file.
+type historyStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newHistoryStore(dir string) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &historyStore{dir: dir}, nil
+}
+
+func (s *historyStore) path(namespace, rollout string) string {
+	// Both are validated Kubernetes names, which can't contain path separators.
+	return filepath.Join(s.dir, fmt.Sprintf("%s_%s.jsonl", namespace, rollout))
+}
+
+func (s *historyStore) append(e *evaluation) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path(e.Namespace, e.Rollout), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if info.Size() > maxHistoryFileSize {
+		path := s.path(e.Namespace, e.Rollout)
+		return os.Rename(path, path+".1")
+	}
+	return nil
+}
+
+// list returns the evaluations of a rollout in the order they were recorded, keeping only the
+// last limit ones when limit is positive.
+func (s *historyStore) list(namespace, rollout string, limit int) ([]evaluation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evaluations := []evaluation{}
+	path := s.path(namespace, rollout)
+	// The rotated file holds the older evaluations.
+	for _, p := range []string{path + ".1", path} {
+		var err error
+		if evaluations, err = readEvaluations(p, evaluations); err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(evaluations) > limit {
+		evaluations = evaluations[len(evaluations)-limit:]
+	}
+	return evaluations, nil
+}
+
+// readEvaluations appends the evaluations of a history file, if it exists, to evaluations.
+func readEvaluations(path string, evaluations []evaluation) ([]evaluation, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return evaluations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Records embed the PxL query and results, which can exceed the default line limit.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e evaluation
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a line truncated by a crash rather than losing the whole history.
+			log.Printf("Skipping unreadable history record in %s: %s\n", path, err.Error())
+			continue
+		}
+		evaluations = append(evaluations, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return evaluations, nil
+}
+
+// historyRollout returns the rollout a request is recorded under: the `rollout` path param of
+// the compare endpoint, or the `rollout` query parameter of the other metric endpoints.
+// Requests without a rollout aren't recorded.
+func historyRollout(req *http.Request, ps httprouter.Params) string {
+	if rollout := ps.ByName("rollout"); rollout != "" {
+		return rollout
+	}
+	return req.URL.Query().Get("rollout")
+}
+
+// recordEvaluation stores an evaluation of the metric endpoints in the history of its
+// rollout. Failing to record is logged rather than failing the analysis.
+func (p *pixieMetricsProvider) recordEvaluation(req *http.Request, ps httprouter.Params, e *evaluation, result interface{}, evalErr error) {
+	if p.history == nil {
+		return
+	}
+	e.Namespace = ps.ByName("namespace")
+	e.Rollout = historyRollout(req, ps)
+	if e.Rollout == "" {
+		return
+	}
+	if err := validateNamespace(e.Namespace); err != nil {
+		return
+	}
+	if err := validatePodName(e.Rollout); err != nil {
+		log.Printf("Not recording evaluation for invalid rollout name %q.\n", e.Rollout)
+		return
+	}
+	if e.Revision == "" {
+		e.Revision = req.URL.Query().Get("hash")
+	}
+	e.Request = req.URL.RequestURI()
+	e.FinishedAt = time.Now().UTC()
+	if evalErr != nil {
+		e.Error = evalErr.Error()
+	}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Failed to encode evaluation result: %s\n", err.Error())
+		}
+		e.Result = data
+	}
+	if err := p.history.append(e); err != nil {
+		log.Printf("Failed to record evaluation of %s/%s: %s\n", e.Namespace, e.Rollout, err.Error())
+	}
+}
+
+// newEvaluation starts the record of an evaluation.
+func newEvaluation(kind string, target podTarget, pxlScript string) *evaluation {
+	return &evaluation{
+		Kind:      kind,
+		Pods:      target.String(),
+		Query:     pxlScript,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+var historyReportTemplate = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Analysis history of {{.Namespace}}/{{.Rollout}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.error { color: #b00020; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Analysis history of {{.Namespace}}/{{.Rollout}}</h1>
+{{if not .Evaluations}}<p>No evaluations recorded.</p>{{else}}
+<table>
+<tr><th>Started</th><th>Duration</th><th>Kind</th><th>Revision</th><th>Pods</th><th>Result</th><th>Request and PxL query</th></tr>
+{{range .Evaluations}}
+<tr>
+<td>{{.StartedAt.Format "2006-01-02 15:04:05 MST"}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Kind}}</td>
+<td>{{.Revision}}</td>
+<td>{{.Pods}}</td>
+{{if .Error}}<td class="error">{{.Error}}</td>{{else}}<td><pre>{{printf "%s" .Result}}</pre></td>{{end}}
+<td><code>{{.Request}}</code><details><summary>PxL query</summary><pre>{{.Query}}</pre></details></td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// getHistory returns the recorded evaluations of a rollout as JSON, or as an HTML report with
+// `format=html`. `limit` keeps only the most recent evaluations.
+func (p *pixieMetricsProvider) getHistory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if p.history == nil {
+		writeError(w, newStatusError(http.StatusServiceUnavailable, "history storage is not configured"))
+		return
+	}
+	namespace, rollout := ps.ByName("namespace"), ps.ByName("rollout")
+	if err := validateNamespace(namespace); err != nil {
+		writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	if err := validatePodName(rollout); err != nil {
+		writeError(w, newStatusError(http.StatusBadRequest, "invalid rollout name %q", rollout))
+		return
+	}
+	limit := 0
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, newStatusError(http.StatusBadRequest, "invalid limit %q: must be a positive integer", s))
+			return
+		}
+		limit = n
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		format = "html"
+	}
+
+	evaluations, err := p.history.list(namespace, rollout, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch format {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = historyReportTemplate.Execute(w, struct {
+			Namespace   string
+			Rollout     string
+			Evaluations []evaluation
+		}{namespace, rollout, evaluations})
+		if err != nil {
+			log.Printf("Failed to render history report: %s\n", err.Error())
+		}
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evaluations)
+	default:
+		writeError(w, newStatusError(http.StatusBadRequest, "invalid format %q: must be json or html", format))
+	}
+}
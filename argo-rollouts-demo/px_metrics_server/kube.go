@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Label Argo Rollouts sets on the pods of each rollout revision.
+const rolloutsPodTemplateHashLabel = "rollouts-pod-template-hash"
+
+// Location of the service account credentials mounted into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal read-only Kubernetes API client, enough to resolve label selectors
+// to pods. It authenticates with the pod's service account.
+type kubeClient struct {
+	host       string
+	token      string
+	httpClient *http.Client
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s/ca.crt", serviceAccountDir)
+	}
+
+	return &kubeClient{
+		host:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubeClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	u := k.host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// listPods returns the names of the running pods in namespace that match the label selector.
+func (k *kubeClient) listPods(ctx context.Context, namespace, selector string) ([]string, error) {
+	var podList struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(namespace))
+	if err := k.get(ctx, path, url.Values{"labelSelector": {selector}}, &podList); err != nil {
+		return nil, err
+	}
+
+	pods := make([]string, 0, len(podList.Items))
+	for _, item := range podList.Items {
+		if item.Status.Phase != "Running" {
+			continue
+		}
+		pods = append(pods, item.Metadata.Name)
+	}
+	sort.Strings(pods)
+	return pods, nil
+}
+
+// serviceSelector returns the pod selector of a Service.
+func (k *kubeClient) serviceSelector(ctx context.Context, namespace, service string) (map[string]string, error) {
+	var svc struct {
+		Spec struct {
+			Selector map[string]string `json:"selector"`
+		} `json:"spec"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(namespace), url.PathEscape(service))
+	if err := k.get(ctx, path, nil, &svc); err != nil {
+		return nil, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("service %s/%s has no selector", namespace, service)
+	}
+	return svc.Spec.Selector, nil
+}
+
+// deploymentSelector returns the pod selector of a Deployment. Only matchLabels selectors are
+// supported.
+func (k *kubeClient) deploymentSelector(ctx context.Context, namespace, deployment string) (map[string]string, error) {
+	var d struct {
+		Spec struct {
+			Selector struct {
+				MatchLabels      map[string]string `json:"matchLabels"`
+				MatchExpressions []interface{}     `json:"matchExpressions"`
+			} `json:"selector"`
+		} `json:"spec"`
+	}
+	path := fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", url.PathEscape(namespace), url.PathEscape(deployment))
+	if err := k.get(ctx, path, nil, &d); err != nil {
+		return nil, err
+	}
+	if len(d.Spec.Selector.MatchExpressions) > 0 {
+		return nil, fmt.Errorf("deployment %s/%s uses matchExpressions, which are not supported", namespace, deployment)
+	}
+	if len(d.Spec.Selector.MatchLabels) == 0 {
+		return nil, fmt.Errorf("deployment %s/%s has no selector", namespace, deployment)
+	}
+	return d.Spec.Selector.MatchLabels, nil
+}
+
+// formatLabelSelector renders a selector map as a label selector string, sorted by key.
+func formatLabelSelector(selector map[string]string) string {
+	keys := make([]string, 0, len(selector))
+	for k := range selector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	terms := make([]string, len(keys))
+	for i, k := range keys {
+		terms[i] = k + "=" + selector[k]
+	}
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeKubeAPI is a Kubernetes API server serving fixed objects by path, and recording the
+// label selectors of the requests.
+type fakeKubeAPI struct {
+	*httptest.Server
+	objects map[string]interface{}
+
+	mu        sync.Mutex
+	requests  int
+	selectors []string
+}
+
+func newFakeKubeAPI(t *testing.T, objects map[string]interface{}) *fakeKubeAPI {
+	f := &fakeKubeAPI{objects: objects}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		f.requests++
+		if s := req.URL.Query().Get("labelSelector"); s != "" {
+			f.selectors = append(f.selectors, s)
+		}
+		f.mu.Unlock()
+		if got := req.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q, want the service account token", got)
+		}
+		obj, ok := f.objects[req.URL.Path]
+		if !ok {
+			http.Error(w, `{"kind":"Status","reason":"NotFound"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeKubeAPI) client() *kubeClient {
+	return &kubeClient{host: f.URL, token: "test-token", httpClient: f.Client()}
+}
+
+func podList(phases map[string]string) map[string]interface{} {
+	var items []interface{}
+	for name, phase := range phases {
+		items = append(items, map[string]interface{}{
+			"metadata": map[string]string{"name": name},
+			"status":   map[string]string{"phase": phase},
+		})
+	}
+	return map[string]interface{}{"items": items}
+}
+
+func service(selector map[string]string) map[string]interface{} {
+	return map[string]interface{}{"spec": map[string]interface{}{"selector": selector}}
+}
+
+func TestFormatLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector map[string]string
+		want     string
+	}{
+		{map[string]string{"app": "carts"}, "app=carts"},
+		{map[string]string{"rollouts-pod-template-hash": "5f7d9c8b6", "app": "carts", "tier": "backend"}, "app=carts,rollouts-pod-template-hash=5f7d9c8b6,tier=backend"},
+		{map[string]string{}, ""},
+	}
+	for _, tc := range tests {
+		if got := formatLabelSelector(tc.selector); got != tc.want {
+			t.Errorf("formatLabelSelector(%v) = %q, want %q", tc.selector, got, tc.want)
+		}
+	}
+}
+
+func TestListPods(t *testing.T) {
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/api/v1/namespaces/default/pods": podList(map[string]string{
+			"carts-b": "Running",
+			"carts-a": "Running",
+			"carts-c": "Pending",
+			"carts-d": "Succeeded",
+			"carts-e": "Failed",
+		}),
+	})
+	selector := "app=carts,rollouts-pod-template-hash=5f7d9c8b6"
+	pods, err := api.client().listPods(context.Background(), "default", selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"carts-a", "carts-b"}; !reflect.DeepEqual(pods, want) {
+		t.Errorf("listPods() = %v, want the running pods %v", pods, want)
+	}
+	if want := []string{selector}; !reflect.DeepEqual(api.selectors, want) {
+		t.Errorf("labelSelector = %v, want %v", api.selectors, want)
+	}
+
+	if _, err := api.client().listPods(context.Background(), "other", selector); err == nil {
+		t.Error("listPods() of a missing namespace succeeded")
+	}
+}
+
+func TestServiceSelector(t *testing.T) {
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/carts":    service(map[string]string{"app": "carts"}),
+		"/api/v1/namespaces/default/services/external": service(nil),
+	})
+	k := api.client()
+	selector, err := k.serviceSelector(context.Background(), "default", "carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"app": "carts"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("serviceSelector() = %v, want %v", selector, want)
+	}
+	if _, err := k.serviceSelector(context.Background(), "default", "external"); err == nil {
+		t.Error("serviceSelector() of a Service without a selector succeeded")
+	}
+	if _, err := k.serviceSelector(context.Background(), "default", "missing"); err == nil {
+		t.Error("serviceSelector() of a missing Service succeeded")
+	}
+}
+
+func TestDeploymentSelector(t *testing.T) {
+	deployment := func(selector map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"spec": map[string]interface{}{"selector": selector}}
+	}
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/apis/apps/v1/namespaces/test/deployments/podinfo": deployment(map[string]interface{}{
+			"matchLabels": map[string]string{"app": "podinfo"},
+		}),
+		"/apis/apps/v1/namespaces/test/deployments/expressions": deployment(map[string]interface{}{
+			"matchExpressions": []interface{}{map[string]interface{}{"key": "app", "operator": "Exists"}},
+		}),
+	})
+	k := api.client()
+	selector, err := k.deploymentSelector(context.Background(), "test", "podinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"app": "podinfo"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("deploymentSelector() = %v, want %v", selector, want)
+	}
+	if _, err := k.deploymentSelector(context.Background(), "test", "expressions"); err == nil {
+		t.Error("deploymentSelector() with matchExpressions succeeded")
+	}
+}
+
+func TestServicePodsTarget(t *testing.T) {
+	api := newFakeKubeAPI(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/carts": service(map[string]string{"app": "carts"}),
+		"/api/v1/namespaces/default/services/idle":  service(map[string]string{"app": "idle"}),
+		"/api/v1/namespaces/default/pods":           podList(map[string]string{"carts-5f7d9c8b6-a": "Running"}),
+	})
+	tests := []struct {
+		name       string
+		service    string
+		query      string
+		wantStatus int
+		wantName   string
+	}{
+		{name: "service", service: "carts", wantName: "default/app=carts"},
+		{name: "revision", service: "carts", query: "?hash=5f7d9c8b6", wantName: "default/app=carts,rollouts-pod-template-hash=5f7d9c8b6"},
+		{name: "invalid hash", service: "carts", query: "?hash=a%2Cb%3Dc", wantStatus: http.StatusBadRequest},
+		{name: "invalid service", service: "Carts", wantStatus: http.StatusBadRequest},
+		{name: "missing service", service: "missing", wantStatus: http.StatusBadGateway},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &pixieMetricsProvider{kubeClient: api.client()}
+			req := httptest.NewRequest(http.MethodGet, "/"+tc.query, nil)
+			target, err := p.servicePodsTarget(req, "default", tc.service)
+			if tc.wantStatus != 0 {
+				var se *statusError
+				if !errors.As(err, &se) || se.status != tc.wantStatus {
+					t.Fatalf("servicePodsTarget() = %v, want a %d error", err, tc.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.name != tc.wantName {
+				t.Errorf("name = %q, want %q", target.name, tc.wantName)
+			}
+			if want := []string{"carts-5f7d9c8b6-a"}; !reflect.DeepEqual(target.pods, want) {
+				t.Errorf("pods = %v, want %v", target.pods, want)
+			}
+		})
+	}
+
+	t.Run("invalid hash is rejected before the API call", func(t *testing.T) {
+		api := newFakeKubeAPI(t, nil)
+		p := &pixieMetricsProvider{kubeClient: api.client()}
+		req := httptest.NewRequest(http.MethodGet, "/?hash=x%22y", nil)
+		if _, err := p.servicePodsTarget(req, "default", "carts"); err == nil {
+			t.Fatal("servicePodsTarget() succeeded")
+		}
+		if api.requests != 0 {
+			t.Errorf("made %d API requests, want none", api.requests)
+		}
+	})
+
+	t.Run("no running pods", func(t *testing.T) {
+		api := newFakeKubeAPI(t, map[string]interface{}{
+			"/api/v1/namespaces/default/services/carts": service(map[string]string{"app": "carts"}),
+			"/api/v1/namespaces/default/pods":           podList(map[string]string{"carts-a": "Pending"}),
+		})
+		p := &pixieMetricsProvider{kubeClient: api.client()}
+		_, err := p.servicePodsTarget(httptest.NewRequest(http.MethodGet, "/", nil), "default", "carts")
+		var se *statusError
+		if !errors.As(err, &se) || se.status != http.StatusNotFound {
+			t.Errorf("servicePodsTarget() = %v, want a 404 error", err)
+		}
+	})
+
+	t.Run("no Kubernetes API", func(t *testing.T) {
+		p := &pixieMetricsProvider{}
+		_, err := p.servicePodsTarget(httptest.NewRequest(http.MethodGet, "/", nil), "default", "carts")
+		var se *statusError
+		if !errors.As(err, &se) || se.status != http.StatusServiceUnavailable {
+			t.Errorf("servicePodsTarget() = %v, want a 503 error", err)
+		}
+	})
+}
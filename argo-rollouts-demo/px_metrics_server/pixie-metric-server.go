@@ -25,7 +25,10 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"px.dev/pxapi"
@@ -33,12 +36,15 @@ import (
 )
 
 // PxL script to compute the metrics. Could be extended to compute additional metrics.
+// The script variables are filled in with quoted PxL string literals, see pxlString, followed
+// by the failure classification (see errorClassifier), the pod filter (see podTarget) and the
+// optional endpoint breakdown (see endpointBreakdown).
 const timeWindow = "-30s"
 const pxlScript = `import px
 
-POD_NAMESPACE="%s"
-POD_NAME="%s"
-START_TIME="%s"
+POD_NAMESPACE=%s
+POD_NAME=%s
+START_TIME=%s
 
 # Get HTTP events (not all pods will have this)
 df = px.DataFrame(table='http_events', start_time=START_TIME)
@@ -49,10 +55,10 @@ df.pod = df.ctx['pod']
 
 # Filter HTTP events
 df = df[df.trace_role == 2]
-df.failure = df.resp_status >= 400
+%s
 df = df[df.namespace == POD_NAMESPACE]
-df = df[px.contains(df.pod, POD_NAME)]
-
+df = df[%s]
+%s
 # Aggregate throughput, errors, latency for inbound requests to matching pods.
 df = df.agg(
     http_req_count_in=('latency', px.count),
@@ -68,13 +74,75 @@ df.http_error_rate_in = px.Percent(
 px.display(df[['pod', 'http_error_rate_in']], 'pod_stats')
 `
 
+// Kubernetes object naming rules. Namespaces must be DNS-1123 labels and pods DNS-1123 subdomains.
+const (
+	dns1123LabelMaxLength     = 63
+	dns1123SubdomainMaxLength = 253
+)
+
+var (
+	dns1123LabelRegexp     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	dns1123SubdomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+func validateNamespace(namespace string) error {
+	if len(namespace) > dns1123LabelMaxLength || !dns1123LabelRegexp.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q: must be a DNS-1123 label", namespace)
+	}
+	return nil
+}
+
+func validatePodName(pod string) error {
+	if len(pod) > dns1123SubdomainMaxLength || !dns1123SubdomainRegexp.MatchString(pod) {
+		return fmt.Errorf("invalid pod name %q: must be a DNS-1123 subdomain", pod)
+	}
+	return nil
+}
+
+func validateServiceName(service string) error {
+	if len(service) > dns1123LabelMaxLength || !dns1123LabelRegexp.MatchString(service) {
+		return fmt.Errorf("invalid service name %q: must be a DNS-1123 label", service)
+	}
+	return nil
+}
+
+// validatePodTemplateHash checks a `hash` query parameter, which is added to a label selector.
+func validatePodTemplateHash(hash string) error {
+	if len(hash) > dns1123LabelMaxLength || !dns1123LabelRegexp.MatchString(hash) {
+		return fmt.Errorf("invalid hash %q: must be a DNS-1123 label", hash)
+	}
+	return nil
+}
+
+// pxlString returns s as a double-quoted PxL string literal. PxL shares Python's string
+// escape sequences, so any quote, backslash or control character is escaped and the value
+// can never terminate the literal early.
+func pxlString(s string) string {
+	return strconv.QuoteToASCII(s)
+}
+
+// buildErrorRateScript returns the PxL script computing the error rate of the target pods.
+func buildErrorRateScript(t podTarget, c errorClassifier, b endpointBreakdown) string {
+	return fmt.Sprintf(pxlScript, pxlString(t.namespace), pxlString(t.name), pxlString(timeWindow),
+		c.failureColumn(), t.podFilter("df.pod"), b.pxl())
+}
+
 type pixieMetricsProvider struct {
 	vizierClient *pxapi.VizierClient
-	dataMux      sync.Mutex
-	podErrorRate map[string]float64
+	kubeClient   *kubeClient
+	baselines    *baselineStore
+	history      *historyStore
+
+	// Server settings, see serverConfig.
+	queryTimeout        time.Duration
+	livenessGracePeriod time.Duration
+	startedAt           time.Time
+	health              vizierHealth
+	// draining is set to 1 once the server is shutting down.
+	draining int32
 }
 
-func newPixieMetricProvider(apiKey string, cloudAddr string, clusterID string) *pixieMetricsProvider {
+func newPixieMetricProvider(apiKey string, cloudAddr string, clusterID string) (*pixieMetricsProvider, error) {
 	// Create Pixie client.
 	log.Println("Creating Pixie client.")
 	ctx := context.Background()
@@ -84,66 +152,155 @@ func newPixieMetricProvider(apiKey string, cloudAddr string, clusterID string) *
 	}
 	pixieClient, err := pxapi.NewClient(ctx, opts...)
 	if err != nil {
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 	vz, err := pixieClient.NewVizierClient(ctx, clusterID)
 	if err != nil {
-		log.Fatalln(err.Error())
+		return nil, err
+	}
+
+	// Create Kubernetes client, used to resolve label selectors to pods.
+	kc, err := newInClusterKubeClient()
+	if err != nil {
+		log.Printf("Kubernetes API unavailable, selector endpoints are disabled: %s\n", err.Error())
 	}
 
 	// Create pixieMetricsProvider.
 	provider := &pixieMetricsProvider{
 		vizierClient: vz,
-		podErrorRate: make(map[string]float64),
+		kubeClient:   kc,
+		startedAt:    time.Now(),
 	}
 
-	return provider
+	return provider, nil
 }
 
-func (p *pixieMetricsProvider) computeMetrics(ctx context.Context, pxlScript string) {
-	tm := &tableMux{
-		onPodStatsComplete: func(newStats map[string]float64) {
-			p.dataMux.Lock()
-			defer p.dataMux.Unlock()
-			p.podErrorRate = newStats
-		},
+// pixieCredentialsFromEnv reads the Pixie API credentials from the environment.
+func pixieCredentialsFromEnv() (apiKey string, cloudAddr string, clusterID string, err error) {
+	cloudAddr = os.Getenv("PX_CLOUD_ADDR")
+	clusterID = os.Getenv("PX_CLUSTER_ID")
+	if clusterID == "" {
+		return "", "", "", fmt.Errorf("`PX_CLUSTER_ID` is not set. Did you remember to set the `px-credentials` secret?")
+	}
+	apiKey = os.Getenv("PX_API_KEY")
+	if apiKey == "" {
+		return "", "", "", fmt.Errorf("`PX_API_KEY` is not set. Did you remember to set the `px-credentials` secret?")
 	}
+	return apiKey, cloudAddr, clusterID, nil
+}
+
+// executeScript runs the PxL script and streams its output tables to tm.
+func (p *pixieMetricsProvider) executeScript(ctx context.Context, pxlScript string, tm pxapi.TableMuxer) error {
 	log.Println("Executing PxL query.")
 	results, err := p.vizierClient.ExecuteScript(ctx, pxlScript, tm)
 	if err != nil {
-		log.Printf("Error executing PxL script: %s\n", err.Error())
+		return err
 	}
-	if err = results.Stream(); err != nil {
+	defer results.Close()
+	return results.Stream()
+}
+
+// computeMetrics runs the error rate script and returns the error rate by pod. The endpoint
+// breakdown, if the script has one, is collected into endpoints. The stats are collected per
+// call, so concurrent analyses never see each other's results.
+func (p *pixieMetricsProvider) computeMetrics(ctx context.Context, pxlScript string, endpoints *endpointErrorsCollector) (map[string]float64, error) {
+	var stats map[string]float64
+	tm := &tableMux{
+		endpointErrors: endpoints,
+		onPodStatsComplete: func(newStats map[string]float64) {
+			stats = newStats
+		},
+	}
+	err := p.executeScript(ctx, pxlScript, tm)
+	if err != nil {
 		log.Printf("Error executing PxL script: %s\n", err.Error())
 	}
+	return stats, err
 }
 
-func (p *pixieMetricsProvider) errors(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	// Get URL params.
-	namespace := ps.ByName("namespace")
-	pod := ps.ByName("pod")
+// errorRate returns the handler computing the HTTP error rate of the pods found by resolve.
+func (p *pixieMetricsProvider) errorRate(resolve targetResolver) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		classifier, err := parseErrorClassifier(req.URL.Query())
+		if err != nil {
+			writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+			return
+		}
+		breakdown, err := parseEndpointBreakdown(req.URL.Query())
+		if err != nil {
+			writeError(w, &statusError{status: http.StatusBadRequest, err: err})
+			return
+		}
+		target, err := resolve(req, ps)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		p.writeErrorRate(w, req, ps, buildErrorRateScript(target, classifier, breakdown), target, breakdown)
+	}
+}
 
-	// Pixie refers to pods in the <namespace>/<pod> format.
-	pixiePodName := namespace + "/" + pod
-	pxlScript := fmt.Sprintf(pxlScript, namespace, pixiePodName, timeWindow)
+// errorRateResponse is the response of the error rate endpoints. The endpoint fields are only
+// set when the endpoint breakdown is requested.
+type errorRateResponse struct {
+	ErrorRate float64 `json:"error_rate"`
+	// WorstEndpointErrorRate is the error rate of WorstEndpoint, so that Argo can gate on a
+	// single endpoint failing.
+	WorstEndpointErrorRate *float64         `json:"worst_endpoint_error_rate,omitempty"`
+	WorstEndpoint          *endpointErrors  `json:"worst_endpoint,omitempty"`
+	Endpoints              []endpointErrors `json:"endpoints,omitempty"`
+}
 
+// writeErrorRate runs the PxL script and writes the error rate reported for target.
+func (p *pixieMetricsProvider) writeErrorRate(w http.ResponseWriter, req *http.Request, ps httprouter.Params,
+	pxlScript string, target podTarget, breakdown endpointBreakdown) {
 	// Compute metrics.
-	ctx := context.Background()
-	p.computeMetrics(ctx, pxlScript)
+	ctx, cancel := p.queryContext(req)
+	defer cancel()
+	var endpoints *endpointErrorsCollector
+	if breakdown.enabled {
+		endpoints = &endpointErrorsCollector{}
+	}
+	e := newEvaluation(evaluationErrorRate, target, pxlScript)
+	stats, err := p.computeMetrics(ctx, pxlScript, endpoints)
+	if err != nil {
+		p.recordEvaluation(req, ps, e, nil, err)
+		writeError(w, queryError(ctx, err))
+		return
+	}
 
-	// Get metric for pod.
-	errorRate := p.podErrorRate[pixiePodName]
-	s := fmt.Sprintf("The %s pod(s) has a %2.2f %% error rate.", pod, errorRate)
+	// Get metric for pod. The script reports no row when the pods received no requests.
+	errorRate := stats[target.name]
+	s := fmt.Sprintf("The %s pod(s) has a %2.2f %% error rate.", target, errorRate)
 	log.Println(s)
 
 	// Argo Analysis webhook response needs to requires a JSON response.
 	w.Header().Set("Content-Type", "application/json")
-	m := map[string]float64{"error_rate": errorRate}
-	json.NewEncoder(w).Encode(m)
+	resp := errorRateResponse{ErrorRate: errorRate}
+	if endpoints != nil {
+		resp.Endpoints = endpoints.stats()
+		worstErrorRate := 0.0
+		if resp.WorstEndpoint = worstEndpoint(resp.Endpoints, breakdown.minRequests); resp.WorstEndpoint != nil {
+			worstErrorRate = resp.WorstEndpoint.ErrorRate
+			log.Printf("The worst endpoint of the %s pod(s) is %s %s with a %2.2f %% error rate.\n",
+				target, resp.WorstEndpoint.Method, resp.WorstEndpoint.Path, worstErrorRate*100)
+		}
+		resp.WorstEndpointErrorRate = &worstErrorRate
+	}
+	p.recordEvaluation(req, ps, e, resp, nil)
+	json.NewEncoder(w).Encode(resp)
 }
 
+// Default output table and columns of the metric PxL scripts.
+const (
+	defaultStatsTable  = "pod_stats"
+	statsKeyColumn     = "pod"
+	defaultValueColumn = "http_error_rate_in"
+)
+
 // Implement the TableRecordHandler interface to processes the PxL script output table record-wise.
 type podStatsCollector struct {
+	valueColumn        string
 	podStatsTmp        map[string]float64
 	onPodStatsComplete func(stats map[string]float64)
 }
@@ -153,38 +310,72 @@ func (t *podStatsCollector) HandleInit(ctx context.Context, metadata pxTypes.Tab
 }
 
 func (t *podStatsCollector) HandleRecord(ctx context.Context, r *pxTypes.Record) error {
-	pod := r.GetDatum("pod").String()
-	errorRate, ok := r.GetDatum("http_error_rate_in").(*pxTypes.Float64Value)
-	if ok {
-		t.podStatsTmp[pod] = errorRate.Value()
+	// Tables without a pod column are collected under the empty key.
+	pod := ""
+	if d := r.GetDatum(statsKeyColumn); d != nil {
+		pod = d.String()
+	}
+	if v, ok := datumFloat(r.GetDatum(t.valueColumn)); ok {
+		t.podStatsTmp[pod] = v
 	}
 	return nil
 }
 
+// datumFloat returns the value of a numeric datum as a float64.
+func datumFloat(d pxTypes.Datum) (float64, bool) {
+	switch v := d.(type) {
+	case *pxTypes.Float64Value:
+		return v.Value(), true
+	case *pxTypes.Int64Value:
+		return float64(v.Value()), true
+	}
+	return 0, false
+}
+
 func (t *podStatsCollector) HandleDone(ctx context.Context) error {
 	t.onPodStatsComplete(t.podStatsTmp)
 	return nil
 }
 
 // Implement the TableMuxer to route pxl script output tables to the correct handler.
+// The table and value column default to `pod_stats` and `http_error_rate_in`.
 type tableMux struct {
+	tableName          string
+	valueColumn        string
 	podStatsCollector  *podStatsCollector
 	onPodStatsComplete func(stats map[string]float64)
+	// endpointErrors collects the optional endpoint breakdown table.
+	endpointErrors *endpointErrorsCollector
+}
+
+func (s *tableMux) statsTable() string {
+	if s.tableName == "" {
+		return defaultStatsTable
+	}
+	return s.tableName
 }
 
 func (s *tableMux) AcceptTable(ctx context.Context, metadata pxTypes.TableMetadata) (pxapi.TableRecordHandler, error) {
-	if metadata.Name == "pod_stats" {
+	if metadata.Name == s.statsTable() {
+		valueColumn := s.valueColumn
+		if valueColumn == "" {
+			valueColumn = defaultValueColumn
+		}
 		s.podStatsCollector = &podStatsCollector{
+			valueColumn:        valueColumn,
 			podStatsTmp:        make(map[string]float64),
 			onPodStatsComplete: s.onPodStatsComplete,
 		}
 		return s.podStatsCollector, nil
 	}
+	if metadata.Name == endpointErrorsTable && s.endpointErrors != nil {
+		return s.endpointErrors, nil
+	}
 	return nil, fmt.Errorf("Table %s not found", metadata.Name)
 }
 
 func (s *tableMux) GetTable(tableName string) *podStatsCollector {
-	if tableName == "pod_stats" {
+	if tableName == s.statsTable() {
 		return s.podStatsCollector
 	}
 	return nil
@@ -192,21 +383,68 @@ func (s *tableMux) GetTable(tableName string) *podStatsCollector {
 
 func main() {
 
+	// When launched by the Argo Rollouts controller, run as a metric provider plugin instead.
+	if os.Getenv(pluginHandshake.MagicCookieKey) == pluginHandshake.MagicCookieValue {
+		servePlugin()
+		return
+	}
+
 	log.Println("Starting Pixie metrics server.")
 
+	config, err := serverConfigFromEnv()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	auth, err := authConfigFromEnv()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
 	// Get Pixie API credentials.
-	cloudAddr := os.Getenv("PX_CLOUD_ADDR")
-	clusterID := os.Getenv("PX_CLUSTER_ID")
-	if clusterID == "" {
-		log.Fatalln("`PX_CLUSTER_ID` is not set. Did you remember to set the `px-credentials` secret?")
+	apiKey, cloudAddr, clusterID, err := pixieCredentialsFromEnv()
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
-	apiKey := os.Getenv("PX_API_KEY")
-	if apiKey == "" {
-		log.Fatalln("`PX_API_KEY` is not set. Did you remember to set the `px-credentials` secret?")
+	p, err := newPixieMetricProvider(apiKey, cloudAddr, clusterID)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	p.queryTimeout = config.queryTimeout
+	p.livenessGracePeriod = config.livenessGracePeriod
+
+	// Baselines are stored on the data volume so they survive restarts.
+	dataDir := os.Getenv("PX_DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if p.baselines, err = newBaselineStore(dataDir); err != nil {
+		log.Printf("Baseline storage unavailable, baseline endpoints are disabled: %s\n", err.Error())
+	}
+	if p.history, err = newHistoryStore(filepath.Join(dataDir, "history")); err != nil {
+		log.Printf("History storage unavailable, evaluations are not recorded: %s\n", err.Error())
 	}
-	p := newPixieMetricProvider(apiKey, cloudAddr, clusterID)
 
-	router := httprouter.New()
-	router.GET("/error-rate/:namespace/:pod", p.errors)
-	log.Fatal(http.ListenAndServe(":8080", router))
+	router := newRouter()
+	router.GET("/livez", p.livez)
+	router.GET("/readyz", p.readyz)
+	router.GET("/error-rate/:namespace/:pod", p.errorRate(podNameTarget))
+	router.GET("/selector/error-rate/:namespace", p.errorRate(p.selectorTarget))
+	router.GET("/service/error-rate/:namespace/:service", p.errorRate(p.serviceTarget))
+	router.GET("/downstream/:namespace/:pod", p.downstream(podNameTarget))
+	router.GET("/selector/downstream/:namespace", p.downstream(p.selectorTarget))
+	router.GET("/service/downstream/:namespace/:service", p.downstream(p.serviceTarget))
+	router.POST("/baseline/:namespace/:rollout/:revision", p.captureBaseline)
+	router.GET("/baseline/:namespace/:rollout/:revision", p.getBaseline)
+	router.GET("/compare/:namespace/:rollout/:revision", p.compareBaseline)
+	router.GET("/history/:namespace/:rollout", p.getHistory)
+	router.POST("/flagger/webhook", p.flaggerWebhook)
+	router.GET("/flagger/api/v1/query", p.flaggerQueryHandler)
+	router.POST("/flagger/api/v1/query", p.flaggerQueryHandler)
+	handler, err := newAuthHandler(router, auth)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := p.serve(config, auth, handler); err != nil {
+		log.Fatalln(err.Error())
+	}
 }
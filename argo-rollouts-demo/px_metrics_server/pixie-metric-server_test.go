@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		valid     bool
+	}{
+		{"simple", "default", true},
+		{"dashes", "px-sock-shop", true},
+		{"max length", strings.Repeat("a", 63), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", 64), false},
+		{"double quote", `default"`, false},
+		{"single quote", "default'", false},
+		{"newline", "default\nimport os", false},
+		{"pxl injection", "default') or px.contains(df.pod, '", false},
+		{"unicode", "défault", false},
+		{"uppercase", "Default", false},
+		{"leading dash", "-default", false},
+		{"dot", "a.b", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateNamespace(tc.namespace)
+			if (err == nil) != tc.valid {
+				t.Errorf("validateNamespace(%q) = %v, want valid=%v", tc.namespace, err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestValidatePodName(t *testing.T) {
+	tests := []struct {
+		name  string
+		pod   string
+		valid bool
+	}{
+		{"simple", "carts-5f7d9c8b6-abcde", true},
+		{"dots", "carts.v2", true},
+		{"max length", strings.Repeat("a", 253), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", 254), false},
+		{"double quote", `carts"`, false},
+		{"single quote", "carts'", false},
+		{"newline", "carts\npx.display(df)", false},
+		{"pxl injection", "carts') or True or ('", false},
+		{"slash", "default/carts", false},
+		{"unicode", "cärts", false},
+		{"trailing dot", "carts.", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePodName(tc.pod)
+			if (err == nil) != tc.valid {
+				t.Errorf("validatePodName(%q) = %v, want valid=%v", tc.pod, err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestPxlString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "default/carts", `"default/carts"`},
+		{"double quote", `a"b`, `"a\"b"`},
+		{"single quote", "a'b", `"a'b"`},
+		{"pxl injection", "x') or True or ('", `"x') or True or ('"`},
+		{"newline", "a\nimport os", `"a\nimport os"`},
+		{"carriage return", "a\rb", `"a\rb"`},
+		{"backslash", `a\`, `"a\\"`},
+		{"unicode", "cärts", `"c\u00e4rts"`},
+		{"emoji", "😀", `"\U0001f600"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pxlString(tc.in); got != tc.want {
+				t.Errorf("pxlString(%q) = %s, want %s", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewPodNameTargetRejectsHostileInput(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		pod       string
+	}{
+		{"quote in namespace", `default"`, "carts"},
+		{"newline in pod", "default", "carts\nimport os"},
+		{"injection in pod", "default", "carts') or True or ('"},
+		{"unicode pod", "default", "cärts"},
+		{"long pod", "default", strings.Repeat("a", 254)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newPodNameTarget(tc.namespace, tc.pod)
+			var se *statusError
+			if !errors.As(err, &se) || se.status != http.StatusBadRequest {
+				t.Errorf("newPodNameTarget(%q, %q) = %v, want a 400 error", tc.namespace, tc.pod, err)
+			}
+		})
+	}
+}
+
+func TestBuildErrorRateScript(t *testing.T) {
+	target, err := newPodNameTarget("default", "carts-5f7d9c8b6-abcde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := buildErrorRateScript(target, errorClassifier{mode: classifyHTTP}, endpointBreakdown{})
+	for _, line := range []string{
+		`POD_NAMESPACE="default"`,
+		`POD_NAME="default/carts-5f7d9c8b6-abcde"`,
+		`START_TIME="-30s"`,
+		"df.failure = df.resp_status >= 400",
+		"df = df[px.contains(df.pod, POD_NAME)]",
+	} {
+		if !containsLine(script, line) {
+			t.Errorf("script is missing the line %q:\n%s", line, script)
+		}
+	}
+}
+
+func TestBuildErrorRateScriptQuotesHostileValues(t *testing.T) {
+	// Bypass the validation, to check that the values can't break out of their literals anyway.
+	tests := []struct {
+		name          string
+		target        podTarget
+		wantNamespace string
+		wantPod       string
+	}{
+		{
+			name:          "quotes",
+			target:        podTarget{namespace: `a"b'c`, name: `a"b'c/d"e`},
+			wantNamespace: `POD_NAMESPACE="a\"b'c"`,
+			wantPod:       `POD_NAME="a\"b'c/d\"e"`,
+		},
+		{
+			name:          "newlines",
+			target:        podTarget{namespace: "ns\nimport os", name: "ns/pod\npx.display(df)"},
+			wantNamespace: `POD_NAMESPACE="ns\nimport os"`,
+			wantPod:       `POD_NAME="ns/pod\npx.display(df)"`,
+		},
+		{
+			name:          "pxl injection",
+			target:        podTarget{namespace: "ns", name: "ns/x') or True or ('"},
+			wantNamespace: `POD_NAMESPACE="ns"`,
+			wantPod:       `POD_NAME="ns/x') or True or ('"`,
+		},
+		{
+			name:          "unicode",
+			target:        podTarget{namespace: "nś", name: "nś/pöd"},
+			wantNamespace: `POD_NAMESPACE="n\u015b"`,
+			wantPod:       `POD_NAME="n\u015b/p\u00f6d"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			script := buildErrorRateScript(tc.target, errorClassifier{mode: classifyHTTP}, endpointBreakdown{})
+			for _, line := range []string{tc.wantNamespace, tc.wantPod} {
+				if !containsLine(script, line) {
+					t.Errorf("script is missing the line %q:\n%s", line, script)
+				}
+			}
+			for _, line := range strings.Split(script, "\n") {
+				if line == "import os" || line == "px.display(df)" {
+					t.Errorf("injected line %q in script:\n%s", line, script)
+				}
+			}
+		})
+	}
+}
+
+func containsLine(script, line string) bool {
+	for _, l := range strings.Split(script, "\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	goPlugin "github.com/hashicorp/go-plugin"
+)
+
+// Name of the plugin in the `argo-rollouts-config` ConfigMap and in AnalysisTemplates.
+const pluginName = "pixie-io/px-metrics"
+
+const defaultPluginTimeout = 30 * time.Second
+
+// pluginHandshake must match the handshake the Argo Rollouts controller uses for metric
+// provider plugins.
+var pluginHandshake = goPlugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "ARGO_ROLLOUTS_RPC_PLUGIN",
+	MagicCookieValue: "metrics",
+}
+
+// The types below mirror the net/rpc wire types of Argo Rollouts' metricproviders/plugin/rpc
+// package. gob matches struct fields by name and skips the ones the receiver doesn't declare,
+// so only the fields the plugin needs are listed. This avoids depending on the whole Argo
+// Rollouts module and its pinned Kubernetes libraries. net/rpc only serves methods whose reply
+// types are exported, hence the exported names.
+
+type AnalysisPhase string
+
+const (
+	analysisPhaseSuccessful   AnalysisPhase = "Successful"
+	analysisPhaseFailed       AnalysisPhase = "Failed"
+	analysisPhaseError        AnalysisPhase = "Error"
+	analysisPhaseInconclusive AnalysisPhase = "Inconclusive"
+)
+
+type ObjectMeta struct {
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+type AnalysisRun struct {
+	ObjectMeta ObjectMeta
+}
+
+type MetricProvider struct {
+	Plugin map[string]json.RawMessage
+}
+
+type Metric struct {
+	Name             string
+	SuccessCondition string
+	FailureCondition string
+	Provider         MetricProvider
+}
+
+type Measurement struct {
+	Phase      AnalysisPhase
+	Message    string
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Value      string
+	Metadata   map[string]string
+	ResumeAt   *time.Time
+}
+
+type RpcError struct {
+	ErrorString string
+}
+
+type RunArgs struct {
+	AnalysisRun *AnalysisRun
+	Metric      Metric
+}
+
+type TerminateAndResumeArgs struct {
+	AnalysisRun *AnalysisRun
+	Metric      Metric
+	Measurement Measurement
+}
+
+type GarbageCollectArgs struct {
+	AnalysisRun *AnalysisRun
+	Metric      Metric
+	Limit       int
+}
+
+type GetMetadataArgs struct {
+	Metric Metric
+}
+
+func init() {
+	// The names must match the ones Argo Rollouts registers for the call arguments.
+	gob.RegisterName("RunArgs", new(RunArgs))
+	gob.RegisterName("TerminateAndResumeArgs", new(TerminateAndResumeArgs))
+	gob.RegisterName("GarbageCollectArgs", new(GarbageCollectArgs))
+	gob.RegisterName("GetMetadataArgs", new(GetMetadataArgs))
+	gob.RegisterName("RpcError", new(RpcError))
+}
+
+// pluginConfig is the plugin section of an AnalysisTemplate metric provider.
+type pluginConfig struct {
+	// Query is the PxL script to run. Argo substitutes the template args before calling the plugin.
+	Query string `json:"query"`
+	// Table is the output table holding the metric. Defaults to `pod_stats`.
+	Table string `json:"table,omitempty"`
+	// Column is the metric column of the output table. Defaults to `http_error_rate_in`.
+	Column string `json:"column,omitempty"`
+	// TimeoutSeconds bounds the PxL query execution. Defaults to 30 seconds.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+func parsePluginConfig(m Metric) (*pluginConfig, error) {
+	raw, ok := m.Provider.Plugin[pluginName]
+	if !ok {
+		return nil, fmt.Errorf("metric %s has no %s plugin config", m.Name, pluginName)
+	}
+	var config pluginConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid %s plugin config: %w", pluginName, err)
+	}
+	if strings.TrimSpace(config.Query) == "" {
+		return nil, fmt.Errorf("%s plugin config is missing `query`", pluginName)
+	}
+	return &config, nil
+}
+
+// pixieRPCPlugin is the Argo Rollouts metric provider. Each measurement runs the PxL query from
+// the AnalysisTemplate and evaluates the collected values against the metric's
+// successCondition and failureCondition.
+type pixieRPCPlugin struct {
+	provider *pixieMetricsProvider
+}
+
+func (g *pixieRPCPlugin) initPlugin() error {
+	apiKey, cloudAddr, clusterID, err := pixieCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	p, err := newPixieMetricProvider(apiKey, cloudAddr, clusterID)
+	if err != nil {
+		return err
+	}
+	g.provider = p
+	return nil
+}
+
+func (g *pixieRPCPlugin) run(m Metric) Measurement {
+	startTime := time.Now()
+	result := Measurement{
+		StartedAt: &startTime,
+	}
+	if g.provider == nil {
+		return markMeasurementError(result, fmt.Errorf("plugin is not initialized"))
+	}
+
+	config, err := parsePluginConfig(m)
+	if err != nil {
+		return markMeasurementError(result, err)
+	}
+	timeout := defaultPluginTimeout
+	if config.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stats map[string]float64
+	tm := &tableMux{
+		tableName:   config.Table,
+		valueColumn: config.Column,
+		onPodStatsComplete: func(newStats map[string]float64) {
+			stats = newStats
+		},
+	}
+	if err := g.provider.executeScript(ctx, config.Query, tm); err != nil {
+		return markMeasurementError(result, err)
+	}
+	if len(stats) == 0 {
+		return markMeasurementError(result, fmt.Errorf("PxL query returned no %s rows", tm.statsTable()))
+	}
+
+	value, values := pluginResult(stats)
+	phase, err := evaluateResult(values, m)
+	if err != nil {
+		return markMeasurementError(result, err)
+	}
+	log.Printf("Metric %s measured %s (%s).\n", m.Name, value, phase)
+	result.Value = value
+	result.Phase = phase
+	finishedTime := time.Now()
+	result.FinishedAt = &finishedTime
+	return result
+}
+
+func markMeasurementError(m Measurement, err error) Measurement {
+	m.Phase = analysisPhaseError
+	m.Message = err.Error()
+	if m.FinishedAt == nil {
+		finishedTime := time.Now()
+		m.FinishedAt = &finishedTime
+	}
+	return m
+}
+
+// pluginResult converts the collected stats into the measurement value and the result the
+// conditions are evaluated against. A single row yields a scalar, several rows a list ordered
+// by pod.
+func pluginResult(stats map[string]float64) (string, interface{}) {
+	if len(stats) == 1 {
+		for _, v := range stats {
+			return strconv.FormatFloat(v, 'f', -1, 64), v
+		}
+	}
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	results := make([]float64, len(keys))
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		results[i] = stats[k]
+		values[i] = strconv.FormatFloat(stats[k], 'f', -1, 64)
+	}
+	return "[" + strings.Join(values, ",") + "]", results
+}
+
+// evaluateResult follows Argo Rollouts' condition semantics: without a failure condition a
+// measurement fails when the success condition is false and vice versa, and a measurement
+// matching neither condition is inconclusive.
+func evaluateResult(result interface{}, m Metric) (AnalysisPhase, error) {
+	success, failure := false, false
+	var err error
+	if m.SuccessCondition != "" {
+		if success, err = evalCondition(result, m.SuccessCondition); err != nil {
+			return analysisPhaseError, err
+		}
+	}
+	if m.FailureCondition != "" {
+		if failure, err = evalCondition(result, m.FailureCondition); err != nil {
+			return analysisPhaseError, err
+		}
+	}
+
+	switch {
+	case m.SuccessCondition == "" && m.FailureCondition == "":
+		return analysisPhaseSuccessful, nil
+	case m.FailureCondition == "":
+		failure = !success
+	case m.SuccessCondition == "":
+		success = !failure
+	}
+	if failure {
+		return analysisPhaseFailed, nil
+	}
+	if !success {
+		return analysisPhaseInconclusive, nil
+	}
+	return analysisPhaseSuccessful, nil
+}
+
+func evalCondition(result interface{}, condition string) (bool, error) {
+	env := map[string]interface{}{
+		"result": result,
+		"isNaN":  math.IsNaN,
+		"isInf":  func(f float64) bool { return math.IsInf(f, 0) },
+	}
+	out, err := expr.Eval(condition, env)
+	if err != nil {
+		return false, fmt.Errorf("evaluating condition %q: %w", condition, err)
+	}
+	b, ok := out.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition %q returned %T, expected bool", condition, out)
+	}
+	return b, nil
+}
+
+// pluginRPCServer is registered as the net/rpc `Plugin` service the Argo Rollouts controller
+// calls into.
+type pluginRPCServer struct {
+	impl *pixieRPCPlugin
+}
+
+func (s *pluginRPCServer) InitPlugin(args interface{}, resp *RpcError) error {
+	if err := s.impl.initPlugin(); err != nil {
+		*resp = RpcError{ErrorString: err.Error()}
+	}
+	return nil
+}
+
+func (s *pluginRPCServer) Run(args interface{}, resp *Measurement) error {
+	a, ok := args.(*RunArgs)
+	if !ok {
+		return fmt.Errorf("invalid args %v", args)
+	}
+	*resp = s.impl.run(a.Metric)
+	return nil
+}
+
+// Measurements complete synchronously in Run, so there is nothing to resume or terminate.
+func (s *pluginRPCServer) Resume(args interface{}, resp *Measurement) error {
+	a, ok := args.(*TerminateAndResumeArgs)
+	if !ok {
+		return fmt.Errorf("invalid args %v", args)
+	}
+	*resp = a.Measurement
+	return nil
+}
+
+func (s *pluginRPCServer) Terminate(args interface{}, resp *Measurement) error {
+	a, ok := args.(*TerminateAndResumeArgs)
+	if !ok {
+		return fmt.Errorf("invalid args %v", args)
+	}
+	*resp = a.Measurement
+	return nil
+}
+
+func (s *pluginRPCServer) GarbageCollect(args interface{}, resp *RpcError) error {
+	*resp = RpcError{}
+	return nil
+}
+
+func (s *pluginRPCServer) Type(args interface{}, resp *string) error {
+	*resp = pluginName
+	return nil
+}
+
+func (s *pluginRPCServer) GetMetadata(args interface{}, resp *map[string]string) error {
+	a, ok := args.(*GetMetadataArgs)
+	if !ok {
+		return fmt.Errorf("invalid args %v", args)
+	}
+	metadata := make(map[string]string)
+	if config, err := parsePluginConfig(a.Metric); err == nil {
+		metadata["ResolvedPxLQuery"] = config.Query
+	}
+	*resp = metadata
+	return nil
+}
+
+// rpcMetricProviderPlugin implements go-plugin's Plugin interface. Only the server side is
+// needed since the Argo Rollouts controller is the client.
+type rpcMetricProviderPlugin struct {
+	impl *pixieRPCPlugin
+}
+
+func (p *rpcMetricProviderPlugin) Server(*goPlugin.MuxBroker) (interface{}, error) {
+	return &pluginRPCServer{impl: p.impl}, nil
+}
+
+func (p *rpcMetricProviderPlugin) Client(*goPlugin.MuxBroker, *rpc.Client) (interface{}, error) {
+	return nil, fmt.Errorf("%s only implements the plugin server", pluginName)
+}
+
+// servePlugin serves the metric provider plugin over go-plugin's net/rpc protocol. It only
+// returns once the Argo Rollouts controller shuts the plugin down.
+func servePlugin() {
+	goPlugin.Serve(&goPlugin.ServeConfig{
+		HandshakeConfig: pluginHandshake,
+		Plugins: map[string]goPlugin.Plugin{
+			"RpcMetricProviderPlugin": &rpcMetricProviderPlugin{impl: &pixieRPCPlugin{}},
+		},
+	})
+}
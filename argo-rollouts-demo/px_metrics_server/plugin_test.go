@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPluginHandshake(t *testing.T) {
+	// The Argo Rollouts controller sets the cookie when it launches the plugin, which main
+	// checks to serve the plugin rather than the HTTP server.
+	if pluginHandshake.MagicCookieKey != "ARGO_ROLLOUTS_RPC_PLUGIN" {
+		t.Errorf("MagicCookieKey = %q, want ARGO_ROLLOUTS_RPC_PLUGIN", pluginHandshake.MagicCookieKey)
+	}
+	if pluginHandshake.MagicCookieValue != "metrics" {
+		t.Errorf("MagicCookieValue = %q, want metrics", pluginHandshake.MagicCookieValue)
+	}
+	if pluginHandshake.ProtocolVersion != 1 {
+		t.Errorf("ProtocolVersion = %d, want 1", pluginHandshake.ProtocolVersion)
+	}
+}
+
+func TestPluginResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		stats      map[string]float64
+		wantValue  string
+		wantResult interface{}
+	}{
+		{
+			name:       "single pod",
+			stats:      map[string]float64{"default/carts-1": 0.25},
+			wantValue:  "0.25",
+			wantResult: 0.25,
+		},
+		{
+			name:       "pods in name order",
+			stats:      map[string]float64{"default/carts-2": 0.5, "default/carts-1": 0, "default/carts-3": 1},
+			wantValue:  "[0,0.5,1]",
+			wantResult: []float64{0, 0.5, 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, result := pluginResult(tc.stats)
+			if value != tc.wantValue {
+				t.Errorf("value = %q, want %q", value, tc.wantValue)
+			}
+			if !reflect.DeepEqual(result, tc.wantResult) {
+				t.Errorf("result = %#v, want %#v", result, tc.wantResult)
+			}
+		})
+	}
+}
+
+func TestEvaluateResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  interface{}
+		success string
+		failure string
+		want    AnalysisPhase
+		wantErr bool
+	}{
+		{name: "no conditions", result: 0.5, want: analysisPhaseSuccessful},
+		{name: "success", result: 0.01, success: "result < 0.05", want: analysisPhaseSuccessful},
+		{name: "success condition false", result: 0.1, success: "result < 0.05", want: analysisPhaseFailed},
+		{name: "failure", result: 0.1, failure: "result >= 0.05", want: analysisPhaseFailed},
+		{name: "failure condition false", result: 0.01, failure: "result >= 0.05", want: analysisPhaseSuccessful},
+		{name: "inconclusive", result: 0.07, success: "result < 0.05", failure: "result > 0.1", want: analysisPhaseInconclusive},
+		{name: "both match", result: 0.2, success: "result > 0.1", failure: "result > 0.1", want: analysisPhaseFailed},
+		{name: "list", result: []float64{0.01, 0.02}, success: "all(result, {# < 0.05})", want: analysisPhaseSuccessful},
+		{name: "list failing", result: []float64{0.01, 0.2}, success: "all(result, {# < 0.05})", want: analysisPhaseFailed},
+		{name: "NaN", result: math.NaN(), success: "!isNaN(result) && result < 0.05", want: analysisPhaseFailed},
+		{name: "invalid condition", result: 0.1, success: "result <", want: analysisPhaseError, wantErr: true},
+		{name: "non-bool condition", result: 0.1, failure: "result * 2", want: analysisPhaseError, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Metric{Name: "error-rate", SuccessCondition: tc.success, FailureCondition: tc.failure}
+			got, err := evaluateResult(tc.result, m)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("evaluateResult() error = %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("evaluateResult() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"px.dev/pxapi"
+	pxTypes "px.dev/pxapi/types"
+)
+
+// serverConfig holds the HTTP server settings, read from the environment.
+type serverConfig struct {
+	// listenAddr is the address the metrics endpoints are served on.
+	listenAddr   string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	// queryTimeout bounds each PxL query. It must be shorter than writeTimeout, and than the
+	// `timeoutSeconds` of the Argo web metrics calling the server.
+	queryTimeout time.Duration
+	// drainDelay is how long the server keeps serving after SIGTERM while failing its readiness
+	// probe, so that Kubernetes stops routing requests to it before it shuts down.
+	drainDelay time.Duration
+	// shutdownTimeout bounds how long in-flight requests get to finish once draining is over.
+	shutdownTimeout time.Duration
+	// livenessGracePeriod is how long Vizier can be unreachable before the liveness probe fails
+	// and the server is restarted.
+	livenessGracePeriod time.Duration
+}
+
+func serverConfigFromEnv() (serverConfig, error) {
+	c := serverConfig{listenAddr: os.Getenv("PX_LISTEN_ADDR")}
+	if c.listenAddr == "" {
+		c.listenAddr = ":8080"
+	}
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+		def time.Duration
+	}{
+		{"PX_READ_TIMEOUT", &c.readTimeout, 10 * time.Second},
+		{"PX_WRITE_TIMEOUT", &c.writeTimeout, 60 * time.Second},
+		{"PX_IDLE_TIMEOUT", &c.idleTimeout, 120 * time.Second},
+		{"PX_QUERY_TIMEOUT", &c.queryTimeout, 15 * time.Second},
+		{"PX_DRAIN_DELAY", &c.drainDelay, 5 * time.Second},
+		{"PX_SHUTDOWN_TIMEOUT", &c.shutdownTimeout, 30 * time.Second},
+		{"PX_LIVENESS_GRACE_PERIOD", &c.livenessGracePeriod, 5 * time.Minute},
+	} {
+		*d.dst = d.def
+		s := os.Getenv(d.env)
+		if s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil || v < 0 {
+			return c, fmt.Errorf("invalid `%s` %q: must be a duration such as 30s", d.env, s)
+		}
+		*d.dst = v
+	}
+	if c.writeTimeout > 0 && c.queryTimeout >= c.writeTimeout {
+		return c, fmt.Errorf("`PX_QUERY_TIMEOUT` (%s) must be shorter than `PX_WRITE_TIMEOUT` (%s)", c.queryTimeout, c.writeTimeout)
+	}
+	return c, nil
+}
+
+// queryContext returns the context to run the PxL queries of a request with. It is canceled
+// when the caller goes away or the query timeout expires.
+func (p *pixieMetricsProvider) queryContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if p.queryTimeout <= 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), p.queryTimeout)
+}
+
+// queryError wraps the error of a PxL query run with ctx with the status code to respond with:
+// 504 if the query timed out, 502 for any other Vizier failure.
+func queryError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return &statusError{status: http.StatusGatewayTimeout, err: fmt.Errorf("PxL query timed out: %w", err)}
+	}
+	return &statusError{status: http.StatusBadGateway, err: err}
+}
+
+// PxL script checking that Vizier is reachable and able to run queries.
+const healthPxlScript = `import px
+
+df = px.DataFrame(table='process_stats', start_time='-30s')
+px.display(df.head(1), 'health')
+`
+
+// How long a Vizier health check result is reused, so that frequent probes don't each run a
+// query.
+const healthCheckTTL = 10 * time.Second
+
+// Implement the TableMuxer to discard every output table.
+type discardMux struct{}
+
+func (discardMux) AcceptTable(ctx context.Context, metadata pxTypes.TableMetadata) (pxapi.TableRecordHandler, error) {
+	return &recordFuncHandler{onRecord: func(*pxTypes.Record) {}}, nil
+}
+
+// vizierHealth tracks whether Vizier is reachable.
+type vizierHealth struct {
+	mu          sync.Mutex
+	lastCheck   time.Time
+	lastHealthy time.Time
+	lastErr     error
+}
+
+// checkVizier returns the error of the latest Vizier health check, running a new one if the
+// latest is older than healthCheckTTL. The query runs without holding the lock, so a slow Vizier
+// doesn't block the probes waiting for it.
+func (p *pixieMetricsProvider) checkVizier(ctx context.Context) error {
+	h := &p.health
+	h.mu.Lock()
+	if !h.lastCheck.IsZero() && time.Since(h.lastCheck) < healthCheckTTL {
+		err := h.lastErr
+		h.mu.Unlock()
+		return err
+	}
+	h.mu.Unlock()
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTTL)
+	defer cancel()
+	err := p.executeScript(ctx, healthPxlScript, discardMux{})
+	if err != nil {
+		log.Printf("Vizier health check failed: %s\n", err.Error())
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Concurrent checks may finish out of order. Keep the result of the latest one.
+	if now.Before(h.lastCheck) {
+		return err
+	}
+	h.lastCheck = now
+	h.lastErr = err
+	if err == nil {
+		h.lastHealthy = now
+	}
+	return err
+}
+
+// unhealthyFor returns how long Vizier has been unreachable, measured from startup if it never
+// was.
+func (p *pixieMetricsProvider) unhealthyFor() time.Duration {
+	p.health.mu.Lock()
+	defer p.health.mu.Unlock()
+	if p.health.lastErr == nil {
+		return 0
+	}
+	since := p.health.lastHealthy
+	if since.IsZero() {
+		since = p.startedAt
+	}
+	return time.Since(since)
+}
+
+type probeResponse struct {
+	Status string `json:"status"`
+	Vizier string `json:"vizier"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeProbe(w http.ResponseWriter, status int, resp probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// livez is the liveness probe. It only fails once Vizier has been unreachable for the liveness
+// grace period, since restarting the server won't help with a short Vizier outage but does
+// recreate a stuck Pixie client.
+func (p *pixieMetricsProvider) livez(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	resp := probeResponse{Status: "ok", Vizier: "ok"}
+	if err := p.checkVizier(req.Context()); err != nil {
+		resp.Vizier = "unreachable"
+		resp.Error = err.Error()
+		if d := p.unhealthyFor(); p.livenessGracePeriod > 0 && d > p.livenessGracePeriod {
+			resp.Status = "unhealthy"
+			resp.Error = fmt.Sprintf("Vizier unreachable for %s: %s", d.Round(time.Second), err.Error())
+			writeProbe(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+	}
+	writeProbe(w, http.StatusOK, resp)
+}
+
+// readyz is the readiness probe. It fails while Vizier is unreachable and while the server is
+// draining.
+func (p *pixieMetricsProvider) readyz(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if atomic.LoadInt32(&p.draining) != 0 {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: "draining", Vizier: "unknown"})
+		return
+	}
+	if err := p.checkVizier(req.Context()); err != nil {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: "unready", Vizier: "unreachable", Error: err.Error()})
+		return
+	}
+	writeProbe(w, http.StatusOK, probeResponse{Status: "ok", Vizier: "ok"})
+}
+
+// newRouter returns the router serving JSON errors for unknown routes, wrong methods and panics.
+func newRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, newStatusError(http.StatusNotFound, "no endpoint at %s", req.URL.Path))
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, newStatusError(http.StatusMethodNotAllowed, "method %s not allowed on %s", req.Method, req.URL.Path))
+	})
+	router.PanicHandler = func(w http.ResponseWriter, req *http.Request, v interface{}) {
+		writeError(w, fmt.Errorf("internal error handling %s: %v", req.URL.Path, v))
+	}
+	return router
+}
+
+// serve runs the HTTP server until SIGTERM or SIGINT, then drains it: the readiness probe fails
+// for the drain delay, after which in-flight requests get the shutdown timeout to finish. The
+// server uses HTTPS when TLS is configured in auth.
+func (p *pixieMetricsProvider) serve(c serverConfig, auth authConfig, handler http.Handler) error {
+	tlsConfig, err := auth.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:         c.listenAddr,
+		Handler:      handler,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  c.readTimeout,
+		WriteTimeout: c.writeTimeout,
+		IdleTimeout:  c.idleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("Listening on %s with TLS.\n", c.listenAddr)
+			errc <- srv.ListenAndServeTLS(auth.tlsCertFile, auth.tlsKeyFile)
+			return
+		}
+		log.Printf("Listening on %s.\n", c.listenAddr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutting down, draining for %s.\n", c.drainDelay)
+	atomic.StoreInt32(&p.draining, 1)
+	time.Sleep(c.drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	log.Println("Shut down.")
+	return nil
+}
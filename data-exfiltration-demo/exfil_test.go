@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testPayload = []byte(`[{"name":"Jane Doe","ssn":"123-45-6789","card":{"number":"4111 1111 1111 1111"}}]`)
+
+// sinkRequest is a request received by the sink.
+type sinkRequest struct {
+	method string
+	header http.Header
+	query  string
+	body   []byte
+	// transferEncoding is the request's Transfer-Encoding, as decoded by the server.
+	transferEncoding []string
+}
+
+// newSink returns an HTTP server recording the requests it receives.
+func newSink(t *testing.T) (*httptest.Server, *[]sinkRequest) {
+	var requests []sinkRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("reading the body: %v", err)
+		}
+		requests = append(requests, sinkRequest{
+			method:           req.Method,
+			header:           req.Header.Clone(),
+			query:            req.URL.RawQuery,
+			body:             body,
+			transferEncoding: req.TransferEncoding,
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s, &requests
+}
+
+func sendToSink(t *testing.T, send func(c *exfilConfig, payload []byte) error) sinkRequest {
+	s, requests := newSink(t)
+	c := &exfilConfig{url: s.URL, client: s.Client()}
+	if err := send(c, testPayload); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("sink received %d requests, want 1", len(*requests))
+	}
+	return (*requests)[0]
+}
+
+func TestPostJSON(t *testing.T) {
+	req := sendToSink(t, postJSON)
+	if req.method != http.MethodPost {
+		t.Errorf("method = %s, want POST", req.method)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if !bytes.Equal(req.body, testPayload) {
+		t.Errorf("body = %s, want the payload", req.body)
+	}
+}
+
+func TestGetQueryString(t *testing.T) {
+	req := sendToSink(t, getQueryString)
+	if req.method != http.MethodGet {
+		t.Errorf("method = %s, want GET", req.method)
+	}
+	if len(req.body) != 0 {
+		t.Errorf("body = %s, want none", req.body)
+	}
+	q, err := url.ParseQuery(req.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Get("data"); got != string(testPayload) {
+		t.Errorf("data = %s, want the payload", got)
+	}
+}
+
+func TestPostBase64(t *testing.T) {
+	req := sendToSink(t, postBase64)
+	if req.method != http.MethodPost {
+		t.Errorf("method = %s, want POST", req.method)
+	}
+	if got := req.header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	if bytes.Contains(req.body, []byte("123-45-6789")) {
+		t.Errorf("body = %s, want the PII encoded", req.body)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(req.body))
+	if err != nil {
+		t.Fatalf("body isn't base64: %v", err)
+	}
+	if !bytes.Equal(decoded, testPayload) {
+		t.Errorf("decoded body = %s, want the payload", decoded)
+	}
+}
+
+func TestPostGzip(t *testing.T) {
+	req := sendToSink(t, postGzip)
+	if req.method != http.MethodPost {
+		t.Errorf("method = %s, want POST", req.method)
+	}
+	if got := req.header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(req.body))
+	if err != nil {
+		t.Fatalf("body isn't gzip: %v", err)
+	}
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, testPayload) {
+		t.Errorf("decoded body = %s, want the payload", decoded)
+	}
+}
+
+func TestPostChunked(t *testing.T) {
+	req := sendToSink(t, postChunked)
+	if req.method != http.MethodPost {
+		t.Errorf("method = %s, want POST", req.method)
+	}
+	if len(req.transferEncoding) != 1 || req.transferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding = %v, want chunked", req.transferEncoding)
+	}
+	if !bytes.Equal(req.body, testPayload) {
+		t.Errorf("body = %s, want the payload", req.body)
+	}
+}
+
+// TestPostChunkedChunkSizes reads the raw request, as net/http hides the chunks.
+func TestPostChunkedChunkSizes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type result struct {
+		sizes []int
+		body  []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { done <- r }()
+		conn, err := l.Accept()
+		if err != nil {
+			r.err = err
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		if _, err := tp.ReadLine(); err != nil {
+			r.err = err
+			return
+		}
+		if _, err := tp.ReadMIMEHeader(); err != nil {
+			r.err = err
+			return
+		}
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				r.err = err
+				return
+			}
+			size, err := strconv.ParseInt(line, 16, 64)
+			if err != nil {
+				r.err = err
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size+2)
+			if _, err := io.ReadFull(tp.R, chunk); err != nil {
+				r.err = err
+				return
+			}
+			r.sizes = append(r.sizes, int(size))
+			r.body = append(r.body, chunk[:size]...)
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	}()
+
+	c := &exfilConfig{url: "http://" + l.Addr().String(), client: &http.Client{}}
+	if err := postChunked(c, testPayload); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !bytes.Equal(r.body, testPayload) {
+		t.Errorf("body = %s, want the payload", r.body)
+	}
+	if want := (len(testPayload) + chunkSize - 1) / chunkSize; len(r.sizes) < want {
+		t.Errorf("got %d chunks, want at least %d", len(r.sizes), want)
+	}
+	for _, size := range r.sizes {
+		if size > chunkSize {
+			t.Errorf("chunk of %d bytes, want at most %d", size, chunkSize)
+		}
+	}
+}
+
+func TestPostMultipart(t *testing.T) {
+	req := sendToSink(t, postMultipart)
+	if req.method != http.MethodPost {
+		t.Errorf("method = %s, want POST", req.method)
+	}
+	mediaType, params, err := mime.ParseMediaType(req.header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("Content-Type = %q, want multipart/form-data", req.header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader(req.body), params["boundary"])
+	form, err := mr.ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := form.Value["description"]; len(got) != 1 || got[0] != "customer export" {
+		t.Errorf("description = %q, want customer export", got)
+	}
+	files := form.File["file"]
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	if !strings.HasPrefix(files[0].Filename, "export-") || !strings.HasSuffix(files[0].Filename, ".json") {
+		t.Errorf("filename = %q, want export-<crc>.json", files[0].Filename)
+	}
+	if got := files[0].Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("file Content-Type = %q, want application/json", got)
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, testPayload) {
+		t.Errorf("file = %s, want the payload", content)
+	}
+}
+
+func TestHTTPModeFailsWithoutSink(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	c := &exfilConfig{url: s.URL, client: &http.Client{}}
+	for _, m := range exfilModes {
+		if !m.http {
+			continue
+		}
+		if err := m.send(c, testPayload); err == nil {
+			t.Errorf("%s succeeded with the sink down", m.name)
+		}
+	}
+}
+
+func TestRawTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	if err := rawTCP(&exfilConfig{tcpAddr: l.Addr().String()}, testPayload); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-received, append(append([]byte(nil), testPayload...), '\n'); !bytes.Equal(got, want) {
+		t.Errorf("received %q, want the payload followed by a newline", got)
+	}
+}
+
+func TestRawTCPFailsWithoutListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if err := rawTCP(&exfilConfig{tcpAddr: addr}, testPayload); err == nil {
+		t.Error("rawTCP() succeeded without a listener")
+	}
+}
+
+func TestParseExfilModes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "post", want: []string{"post"}},
+		{in: "get,base64,gzip,chunked,multipart", want: []string{"get", "base64", "gzip", "chunked", "multipart"}},
+		{in: " dns , tcp ", want: []string{"dns", "tcp"}},
+		{in: "post,post", want: []string{"post", "post"}},
+		{in: "", wantErr: true},
+		{in: "post,", wantErr: true},
+		{in: "ftp", wantErr: true},
+		{in: "post,smtp", wantErr: true},
+		{in: "POST", wantErr: true},
+	}
+	for _, tc := range tests {
+		modes, err := parseExfilModes(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseExfilModes(%q) succeeded, want an error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseExfilModes(%q): %v", tc.in, err)
+			continue
+		}
+		var names []string
+		for _, m := range modes {
+			names = append(names, m.name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("parseExfilModes(%q) = %v, want %v", tc.in, names, tc.want)
+		}
+	}
+}
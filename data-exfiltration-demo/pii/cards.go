@@ -0,0 +1,106 @@
+package pii
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Card is a payment card.
+type Card struct {
+	Network string `json:"network"`
+	Number  string `json:"number"`
+	// Expiry is the month and year, such as `07/27`.
+	Expiry string `json:"expiry"`
+	CVV    string `json:"cvv"`
+}
+
+// cardNetwork describes the numbers of a card network: the ranges of their prefixes, their
+// length and the sizes of the digit groups they are printed in.
+type cardNetwork struct {
+	name     string
+	prefixes [][2]int
+	length   int
+	groups   []int
+}
+
+// First year of the card expiries. It is fixed rather than derived from the current date, so
+// that a seed replays the same cards.
+const cardExpiryBaseYear = 2027
+
+var cardNetworks = []cardNetwork{
+	{"Visa", [][2]int{{4, 4}}, 16, []int{4, 4, 4, 4}},
+	{"Mastercard", [][2]int{{51, 55}, {2221, 2720}}, 16, []int{4, 4, 4, 4}},
+	{"American Express", [][2]int{{34, 34}, {37, 37}}, 15, []int{4, 6, 5}},
+	{"Discover", [][2]int{{6011, 6011}, {644, 649}, {65, 65}}, 16, []int{4, 4, 4, 4}},
+	{"JCB", [][2]int{{3528, 3589}}, 16, []int{4, 4, 4, 4}},
+	{"Diners Club", [][2]int{{36, 36}, {300, 305}}, 14, []int{4, 6, 4}},
+}
+
+// Card returns a card of a random network, with a Luhn-valid number printed with spaces,
+// dashes or no separators, expiring within the 5 years from cardExpiryBaseYear.
+func (g *Generator) Card() Card {
+	n := cardNetworks[g.rand.Intn(len(cardNetworks))]
+	r := n.prefixes[g.rand.Intn(len(n.prefixes))]
+	prefix := strconv.Itoa(r[0] + g.rand.Intn(r[1]-r[0]+1))
+	number := prefix + g.digits(n.length-len(prefix)-1)
+	number += string(luhnCheckDigit(number))
+
+	cvvLen := 3
+	if n.name == "American Express" {
+		cvvLen = 4
+	}
+	return Card{
+		Network: n.name,
+		Number:  g.formatCardNumber(number, n.groups),
+		Expiry:  fmt.Sprintf("%02d/%02d", 1+g.rand.Intn(12), (cardExpiryBaseYear+g.rand.Intn(5))%100),
+		CVV:     g.digits(cvvLen),
+	}
+}
+
+func (g *Generator) formatCardNumber(number string, groups []int) string {
+	sep := []string{" ", "-", ""}[g.rand.Intn(3)]
+	if sep == "" {
+		return number
+	}
+	parts := make([]string, 0, len(groups))
+	for _, size := range groups {
+		parts = append(parts, number[:size])
+		number = number[size:]
+	}
+	return strings.Join(parts, sep)
+}
+
+// luhnCheckDigit returns the digit that makes the number Luhn-valid when appended to it.
+func luhnCheckDigit(number string) byte {
+	sum := luhnSum(number, true)
+	return byte('0' + (10-sum%10)%10)
+}
+
+// luhnSum sums the digits of the number, doubling every other digit from the right, starting
+// with the last one if double is set.
+func luhnSum(number string, double bool) int {
+	sum := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum
+}
+
+// ValidLuhn returns whether s is a card number with a valid Luhn checksum, ignoring spaces and
+// dashes.
+func ValidLuhn(s string) bool {
+	d := strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if len(d) < 12 || len(d) > 19 || !allDigits(d) {
+		return false
+	}
+	return luhnSum(d, false)%10 == 0
+}
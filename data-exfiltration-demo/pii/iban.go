@@ -0,0 +1,82 @@
+package pii
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ibanFormats are the formats of the basic bank account numbers of some countries, as in the
+// IBAN registry: `n` is a digit, `a` an uppercase letter and `c` either.
+var ibanFormats = []struct {
+	country, bban string
+}{
+	{"DE", "nnnnnnnnnnnnnnnnnn"},
+	{"GB", "aaaannnnnnnnnnnnnn"},
+	{"FR", "nnnnnnnnnncccccccccccnn"},
+	{"ES", "nnnnnnnnnnnnnnnnnnnn"},
+	{"NL", "aaaannnnnnnnnn"},
+	{"IT", "annnnnnnnnncccccccccccc"},
+	{"CH", "nnnnncccccccccccc"},
+}
+
+// IBAN returns an international bank account number of a random country with valid check
+// digits, either compact or printed in groups of 4.
+func (g *Generator) IBAN() string {
+	f := ibanFormats[g.rand.Intn(len(ibanFormats))]
+	var sb strings.Builder
+	for _, kind := range f.bban {
+		switch kind {
+		case 'n':
+			sb.WriteString(g.digits(1))
+		case 'a':
+			sb.WriteString(g.chars(upper, 1))
+		default:
+			sb.WriteString(g.chars(upper+"0123456789", 1))
+		}
+	}
+	bban := sb.String()
+	check := 98 - ibanMod97(bban+f.country+"00")
+	iban := f.country + strconv.Itoa(check/10) + strconv.Itoa(check%10) + bban
+	if g.rand.Intn(2) == 0 {
+		return iban
+	}
+	var groups []string
+	for len(iban) > 4 {
+		groups = append(groups, iban[:4])
+		iban = iban[4:]
+	}
+	return strings.Join(append(groups, iban), " ")
+}
+
+// ibanMod97 returns the remainder of the division by 97 of the number that the letters and
+// digits of s spell, with the letters standing for 10 to 35, as in ISO 7064.
+func ibanMod97(s string) int {
+	var digits strings.Builder
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(r-'A') + 10))
+		} else {
+			digits.WriteRune(r)
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok {
+		return -1
+	}
+	return int(new(big.Int).Mod(n, big.NewInt(97)).Int64())
+}
+
+// ValidIBAN returns whether s is an IBAN with valid check digits, ignoring spaces.
+func ValidIBAN(s string) bool {
+	iban := strings.ReplaceAll(s, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	for _, r := range iban {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return ibanMod97(iban[4:]+iban[:4]) == 1
+}
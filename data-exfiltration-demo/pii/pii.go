@@ -0,0 +1,237 @@
+// Package pii generates fake but realistic personally identifiable information, such as card
+// numbers, SSNs and IBANs, to exercise PII egress detectors. The values pass the same checks
+// that real ones do, such as the Luhn checksum of card numbers, so detectors can't tell them
+// apart by their format.
+package pii
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Generator produces PII from a seeded source, so that a run can be reproduced from its seed.
+// It isn't safe for concurrent use.
+type Generator struct {
+	rand *rand.Rand
+}
+
+// New returns a generator seeded with seed.
+func New(seed int64) *Generator {
+	return &Generator{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Record is the PII of a fake person.
+type Record struct {
+	Name    string  `json:"name"`
+	Email   string  `json:"email"`
+	Phone   string  `json:"phone"`
+	SSN     string  `json:"ssn"`
+	Address Address `json:"address"`
+	Card    Card    `json:"card"`
+	IBAN    string  `json:"iban"`
+	Secret  Secret  `json:"secret"`
+}
+
+// Record returns the PII of a new fake person.
+func (g *Generator) Record() Record {
+	first, last := g.pick(firstNames), g.pick(lastNames)
+	return Record{
+		Name:    first + " " + last,
+		Email:   g.email(first, last),
+		Phone:   g.Phone(),
+		SSN:     g.SSN(),
+		Address: g.Address(),
+		Card:    g.Card(),
+		IBAN:    g.IBAN(),
+		Secret:  g.Secret(),
+	}
+}
+
+// Intn returns a number in [0, n) from the generator's source, for callers that vary what
+// they do with the PII reproducibly.
+func (g *Generator) Intn(n int) int {
+	return g.rand.Intn(n)
+}
+
+func (g *Generator) pick(values []string) string {
+	return values[g.rand.Intn(len(values))]
+}
+
+// digits returns n random digits.
+func (g *Generator) digits(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('0' + g.rand.Intn(10))
+	}
+	return string(b)
+}
+
+// chars returns n random characters of the alphabet.
+func (g *Generator) chars(alphabet string, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[g.rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+const (
+	upper        = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var firstNames = []string{
+	"James", "Mary", "Robert", "Patricia", "John", "Jennifer", "Michael", "Linda", "David",
+	"Elizabeth", "William", "Barbara", "Richard", "Susan", "Joseph", "Jessica", "Thomas", "Sarah",
+	"Carlos", "Maria", "Wei", "Mei", "Ahmed", "Fatima", "Hiroshi", "Yuki", "Olga", "Pixie",
+}
+
+var lastNames = []string{
+	"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez",
+	"Martinez", "Hernandez", "Lopez", "Wilson", "Anderson", "Thomas", "Taylor", "Moore", "Jackson",
+	"Nguyen", "Chen", "Kim", "Patel", "Müller", "Rossi", "Dubois", "Tanaka", "Pixienaut",
+}
+
+var emailDomains = []string{
+	"gmail.com", "yahoo.com", "outlook.com", "hotmail.com", "icloud.com", "proton.me",
+	"aol.com", "gmx.de", "example.com", "corp.example.org",
+}
+
+// Email returns the email address of a new fake person.
+func (g *Generator) Email() string {
+	return g.email(g.pick(firstNames), g.pick(lastNames))
+}
+
+func (g *Generator) email(first, last string) string {
+	first, last = asciiLower(first), asciiLower(last)
+	var local string
+	switch g.rand.Intn(5) {
+	case 0:
+		local = first + "." + last
+	case 1:
+		local = first[:1] + last
+	case 2:
+		local = first + "_" + last + g.digits(2)
+	case 3:
+		local = first + last + "+" + g.chars("abcdefghijklmnopqrstuvwxyz", 4)
+	default:
+		local = last + "." + first + g.digits(4)
+	}
+	return local + "@" + g.pick(emailDomains)
+}
+
+// asciiLower lowercases a name and drops its non-ASCII letters, as in email addresses.
+func asciiLower(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Phone returns a phone number in one of several formats: North American numbers with or
+// without the country code and separators, or European numbers in international format.
+func (g *Generator) Phone() string {
+	// North American area codes and exchanges don't start with 0 or 1.
+	area := fmt.Sprintf("%d%s", 2+g.rand.Intn(8), g.digits(2))
+	exchange := fmt.Sprintf("%d%s", 2+g.rand.Intn(8), g.digits(2))
+	line := g.digits(4)
+	switch g.rand.Intn(7) {
+	case 0:
+		return fmt.Sprintf("(%s) %s-%s", area, exchange, line)
+	case 1:
+		return fmt.Sprintf("%s-%s-%s", area, exchange, line)
+	case 2:
+		return fmt.Sprintf("%s.%s.%s", area, exchange, line)
+	case 3:
+		return fmt.Sprintf("+1 %s %s %s", area, exchange, line)
+	case 4:
+		return fmt.Sprintf("+1%s%s%s", area, exchange, line)
+	case 5:
+		return fmt.Sprintf("+44 20 %d%s %s", 7+g.rand.Intn(2), g.digits(3), g.digits(4))
+	default:
+		return fmt.Sprintf("+49 30 %s", g.digits(8))
+	}
+}
+
+// SSN returns a US social security number, dashed or not. Its area isn't 000, 666 or from 900
+// up, and its group and serial aren't zero, which are never issued.
+func (g *Generator) SSN() string {
+	area := 1 + g.rand.Intn(899)
+	if area == 666 {
+		area = 667
+	}
+	group := 1 + g.rand.Intn(99)
+	serial := 1 + g.rand.Intn(9999)
+	if g.rand.Intn(4) == 0 {
+		return fmt.Sprintf("%03d%02d%04d", area, group, serial)
+	}
+	return fmt.Sprintf("%03d-%02d-%04d", area, group, serial)
+}
+
+// ValidSSN returns whether s is a social security number that could be issued, dashed or not.
+func ValidSSN(s string) bool {
+	d := strings.ReplaceAll(s, "-", "")
+	if len(d) != 9 || !allDigits(d) {
+		return false
+	}
+	area, group, serial := d[:3], d[3:5], d[5:]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Address is a US postal address.
+type Address struct {
+	Street string `json:"street"`
+	City   string `json:"city"`
+	State  string `json:"state"`
+	Zip    string `json:"zip"`
+}
+
+func (a Address) String() string {
+	return fmt.Sprintf("%s, %s, %s %s", a.Street, a.City, a.State, a.Zip)
+}
+
+var streetNames = []string{
+	"Main", "Oak", "Pine", "Maple", "Cedar", "Elm", "Washington", "Lake", "Hill", "Park",
+	"Sunset", "Lincoln", "Market", "Mission", "Valencia", "Broadway", "Jackson", "Highland",
+}
+
+var streetSuffixes = []string{"St", "Ave", "Blvd", "Rd", "Ln", "Dr", "Way", "Ct"}
+
+// cities are cities with the first 3 digits of their ZIP codes.
+var cities = []struct {
+	name, state, zip string
+}{
+	{"San Francisco", "CA", "941"},
+	{"Los Angeles", "CA", "900"},
+	{"Seattle", "WA", "981"},
+	{"New York", "NY", "100"},
+	{"Austin", "TX", "787"},
+	{"Chicago", "IL", "606"},
+	{"Boston", "MA", "021"},
+	{"Denver", "CO", "802"},
+	{"Miami", "FL", "331"},
+	{"Portland", "OR", "972"},
+}
+
+// Address returns a street address in a US city, with a ZIP code of the city.
+func (g *Generator) Address() Address {
+	c := cities[g.rand.Intn(len(cities))]
+	street := fmt.Sprintf("%d %s %s", 1+g.rand.Intn(9999), g.pick(streetNames), g.pick(streetSuffixes))
+	if g.rand.Intn(4) == 0 {
+		street += fmt.Sprintf(" Apt %d", 1+g.rand.Intn(999))
+	}
+	return Address{Street: street, City: c.name, State: c.state, Zip: c.zip + g.digits(2)}
+}
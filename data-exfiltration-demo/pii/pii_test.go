@@ -0,0 +1,81 @@
+package pii
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// Seed of the generated samples, fixed so that failures reproduce.
+const testSeed = 42
+
+const testRecords = 10000
+
+var expiryRe = regexp.MustCompile(`^(0[1-9]|1[0-2])/([0-9]{2})$`)
+
+func TestRecordsAreValid(t *testing.T) {
+	g := New(testSeed)
+	for i := 0; i < testRecords; i++ {
+		r := g.Record()
+		if !ValidLuhn(r.Card.Number) {
+			t.Errorf("record %d: card number %q (%s) isn't Luhn-valid", i, r.Card.Number, r.Card.Network)
+		}
+		if !ValidSSN(r.SSN) {
+			t.Errorf("record %d: SSN %q isn't valid", i, r.SSN)
+		}
+		if !ValidIBAN(r.IBAN) {
+			t.Errorf("record %d: IBAN %q isn't valid", i, r.IBAN)
+		}
+		m := expiryRe.FindStringSubmatch(r.Card.Expiry)
+		if m == nil {
+			t.Errorf("record %d: invalid card expiry %q", i, r.Card.Expiry)
+			continue
+		}
+		if year, _ := strconv.Atoi(m[2]); year < cardExpiryBaseYear%100 || year >= cardExpiryBaseYear%100+5 {
+			t.Errorf("record %d: card expiry %q out of range", i, r.Card.Expiry)
+		}
+	}
+}
+
+func TestSeedReplaysRecords(t *testing.T) {
+	a, b := New(testSeed), New(testSeed)
+	for i := 0; i < 100; i++ {
+		if ra, rb := a.Record(), b.Record(); !reflect.DeepEqual(ra, rb) {
+			t.Fatalf("record %d differs with the same seed: %+v and %+v", i, ra, rb)
+		}
+	}
+}
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid func(string) bool
+		value string
+		want  bool
+	}{
+		{"Luhn", ValidLuhn, "4111 1111 1111 1111", true},
+		{"Luhn dashes", ValidLuhn, "4111-1111-1111-1111", true},
+		{"Luhn bad checksum", ValidLuhn, "4111111111111112", false},
+		{"Luhn too short", ValidLuhn, "42", false},
+		{"Luhn letters", ValidLuhn, "4111a11111111111", false},
+		{"SSN", ValidSSN, "123-45-6789", true},
+		{"SSN undashed", ValidSSN, "123456789", true},
+		{"SSN area 000", ValidSSN, "000-45-6789", false},
+		{"SSN area 666", ValidSSN, "666-45-6789", false},
+		{"SSN area 9xx", ValidSSN, "900-45-6789", false},
+		{"SSN group 00", ValidSSN, "123-00-6789", false},
+		{"SSN serial 0000", ValidSSN, "123-45-0000", false},
+		{"IBAN", ValidIBAN, "GB82 WEST 1234 5698 7654 32", true},
+		{"IBAN compact", ValidIBAN, "DE89370400440532013000", true},
+		{"IBAN bad check digits", ValidIBAN, "GB83WEST12345698765432", false},
+		{"IBAN too short", ValidIBAN, "GB82", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.valid(tc.value); got != tc.want {
+				t.Errorf("valid(%q) = %v, want %v", tc.value, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertState is the state of an alert that is firing.
+type alertState struct {
+	Rule string `json:"rule"`
+	// Key identifies the alert among those of its rule, such as `service=px-sock-shop/carts`.
+	Key string `json:"key"`
+	// Refs are the references the notifiers returned when the alert fired, by notifier name,
+	// such as the Slack thread that the updates and the resolution are posted in.
+	Refs        map[string]string `json:"refs"`
+	FiringSince time.Time         `json:"firing_since"`
+	LastSeen    time.Time         `json:"last_seen"`
+	// Channel is the channel of the team owning the alert, for routed rules.
+	Channel string `json:"channel,omitempty"`
+	// AckedBy is the user who acknowledged the alert, which stops its updates.
+	AckedBy string    `json:"acked_by,omitempty"`
+	AckedAt time.Time `json:"acked_at,omitempty"`
+}
+
+// alertStateFile is the content of the state file.
+type alertStateFile struct {
+	Alerts   map[string]*alertState `json:"alerts"`
+	Silences []*silence             `json:"silences"`
+}
+
+// alertTracker follows the lifecycle of the alerts across runs of the script: it notifies when
+// an alert starts firing, on each run while it keeps firing unless acknowledged, and when it
+// resolves. Silenced alerts aren't announced or updated. The state is saved to a file so that
+// restarts don't repeat or lose alerts.
+type alertTracker struct {
+	path        string
+	notifiers   map[string]notifier
+	maintenance []*maintenanceWindow
+	// attach returns the files sent along with a new alert, such as its chart.
+	attach func(ctx context.Context, r *rule, key string, rows []row) []attachment
+	// route returns the channel of the owner of a row, for routed rules.
+	route func(ctx context.Context, rw row) string
+
+	// mu serializes the changes of the state by the jobs, which run concurrently, and by the
+	// users.
+	mu sync.Mutex
+	// ruleMu serializes the updates of each rule.
+	ruleMu map[string]*sync.Mutex
+	// alerts are the firing alerts by rule and key.
+	alerts   map[string]*alertState
+	silences []*silence
+}
+
+func loadAlertTracker(path string, notifiers map[string]notifier, maintenance []*maintenanceWindow) (*alertTracker, error) {
+	t := &alertTracker{path: path, notifiers: notifiers, maintenance: maintenance, alerts: make(map[string]*alertState)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f alertStateFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if f.Alerts != nil {
+		t.alerts = f.Alerts
+	}
+	t.silences = f.Silences
+	return t, nil
+}
+
+// save writes the state file, replacing it atomically. The caller holds t.mu.
+func (t *alertTracker) save() error {
+	b, err := json.MarshalIndent(alertStateFile{Alerts: t.alerts, Silences: t.silences}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+func alertID(ruleName, key string) string {
+	return ruleName + "/" + key
+}
+
+// alertKey returns the key of the alert a matching row belongs to: the values of the rule's
+// key columns, or of the row's string columns if the rule doesn't list any.
+func alertKey(r *rule, rw row) string {
+	columns := r.Key
+	if len(columns) == 0 {
+		columns = stringColumns(rw.metadata)
+	}
+	fields := make([]string, len(columns))
+	for i, col := range columns {
+		fields[i] = fmt.Sprintf("%s=%v", col, rw.value(col))
+	}
+	return strings.Join(fields, ",")
+}
+
+// notify sends n to the rule's notifiers and returns the references they returned. It keeps
+// going when a notifier fails, so that one broken destination doesn't silence the others.
+func (t *alertTracker) notify(ctx context.Context, r *rule, n notification, refs map[string]string) (map[string]string, []string) {
+	newRefs := make(map[string]string)
+	var errs []string
+	for _, name := range r.Notify {
+		n.Ref = refs[name]
+		ref, err := t.notifiers[name].notify(ctx, n)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			if refs[name] != "" {
+				newRefs[name] = refs[name]
+			}
+			continue
+		}
+		newRefs[name] = ref
+	}
+	return newRefs, errs
+}
+
+// pendingNotification is a notification that update sends once it released t.mu.
+type pendingNotification struct {
+	id    string
+	event string
+	state *alertState
+	rows  []row
+	n     notification
+	refs  map[string]string
+}
+
+// update notifies the changes of the rule's alerts given the rows it matched in this run, and
+// saves the new state. The notifiers are called without holding t.mu, so that slow
+// destinations don't block the other jobs and the users' commands.
+func (t *alertTracker) update(ctx context.Context, r *rule, matches []row) error {
+	ruleMu := t.ruleLock(r.Name)
+	ruleMu.Lock()
+	defer ruleMu.Unlock()
+
+	pending := t.pendingNotifications(r, matches, time.Now())
+
+	var errs []string
+	for _, p := range pending {
+		if p.event == eventFiring {
+			if r.Route && t.route != nil {
+				p.state.Channel = t.route(ctx, p.rows[0])
+			}
+			p.n = alertNotification(r, p.state, eventFiring, p.rows)
+			if t.attach != nil {
+				p.n.Attachments = t.attach(ctx, r, p.state.Key, p.rows)
+			}
+		}
+		var notifyErrs []string
+		p.refs, notifyErrs = t.notify(ctx, r, p.n, p.state.Refs)
+		errs = append(errs, notifyErrs...)
+		switch {
+		case p.event == eventFiring && len(notifyErrs) == len(r.Notify):
+			// Nobody was told, so announce it again on the next run.
+			p.refs = nil
+		case p.event == eventResolved && len(notifyErrs) > 0:
+			// Keep the alert to retry on the next run.
+			p.refs = nil
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range pending {
+		if p.refs == nil {
+			continue
+		}
+		switch p.event {
+		case eventFiring:
+			log.Printf("Alert %s is firing.\n", p.id)
+			p.state.Refs = p.refs
+			t.alerts[p.id] = p.state
+		case eventUpdate:
+			if state, ok := t.alerts[p.id]; ok {
+				state.Refs = p.refs
+			}
+		case eventResolved:
+			log.Printf("Alert %s resolved.\n", p.id)
+			delete(t.alerts, p.id)
+		}
+	}
+	if err := t.save(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("rule %q: %s", r.Name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ruleLock returns the mutex serializing the updates of a rule, for the rare runs of a job
+// that overlap.
+func (t *alertTracker) ruleLock(ruleName string) *sync.Mutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ruleMu == nil {
+		t.ruleMu = make(map[string]*sync.Mutex)
+	}
+	mu, ok := t.ruleMu[ruleName]
+	if !ok {
+		mu = &sync.Mutex{}
+		t.ruleMu[ruleName] = mu
+	}
+	return mu
+}
+
+// pendingNotifications records the rows matched in this run in the rule's alerts, and returns
+// the notifications to send. The notifications of new alerts are built once they are routed.
+func (t *alertTracker) pendingNotifications(r *rule, matches []row, now time.Time) []*pendingNotification {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	firing := make(map[string][]row)
+	for _, rw := range matches {
+		key := alertKey(r, rw)
+		firing[key] = append(firing[key], rw)
+	}
+	keys := make([]string, 0, len(firing))
+	for key := range firing {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	t.expireSilences(now)
+	var pending []*pendingNotification
+	for _, key := range keys {
+		rows := firing[key]
+		id := alertID(r.Name, key)
+		state, ok := t.alerts[id]
+		silencedBy := t.silencedBy(r.Name, key, now)
+		if !ok {
+			// New alert.
+			if silencedBy != "" {
+				// Announce it once the silence ends, if it still fires.
+				log.Printf("Alert %s is firing, silenced by %s.\n", id, silencedBy)
+				continue
+			}
+			state = &alertState{Rule: r.Name, Key: key, FiringSince: now, LastSeen: now}
+			pending = append(pending, &pendingNotification{id: id, event: eventFiring, state: state, rows: rows})
+			continue
+		}
+		// Still firing.
+		state.LastSeen = now
+		if state.AckedBy != "" || silencedBy != "" {
+			continue
+		}
+		pending = append(pending, &pendingNotification{
+			id:    id,
+			event: eventUpdate,
+			state: copyAlertState(state),
+			n:     alertNotification(r, state, eventUpdate, rows),
+		})
+	}
+
+	for id, state := range t.alerts {
+		if state.Rule != r.Name || firing[state.Key] != nil {
+			continue
+		}
+		pending = append(pending, &pendingNotification{
+			id:    id,
+			event: eventResolved,
+			state: copyAlertState(state),
+			n:     alertNotification(r, state, eventResolved, nil),
+		})
+	}
+	return pending
+}
+
+// copyAlertState copies the state of an alert, for reading it without holding t.mu.
+func copyAlertState(state *alertState) *alertState {
+	c := *state
+	c.Refs = make(map[string]string, len(state.Refs))
+	for name, ref := range state.Refs {
+		c.Refs[name] = ref
+	}
+	return &c
+}
+
+// alertNotification builds the notification of an alert lifecycle event.
+func alertNotification(r *rule, state *alertState, event string, rows []row) notification {
+	n := notification{
+		Event:       event,
+		Rule:        r.Name,
+		Key:         state.Key,
+		Condition:   r.description(),
+		FiringSince: state.FiringSince,
+		Channel:     state.Channel,
+	}
+	for _, rw := range rows {
+		n.Rows = append(n.Rows, rw.env())
+	}
+	switch event {
+	case eventFiring:
+		n.Title = fmt.Sprintf("%s is firing for %s", r.Name, state.Key)
+		n.Text = alertMessage(r, state.Key, rows)
+	case eventUpdate:
+		n.Title = fmt.Sprintf("%s is still firing for %s", r.Name, state.Key)
+		n.Text = updateMessage(state, rows)
+	case eventResolved:
+		n.Title = fmt.Sprintf("%s resolved for %s", r.Name, state.Key)
+		n.Text = resolvedMessage(r, state, time.Now())
+	}
+	return n
+}
+
+// alertMessage announces a new alert, naming the rule and the offending rows.
+func alertMessage(r *rule, key string, rows []row) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ":rotating_light: *Rule `%s` is firing for `%s`:*\n", r.Name, key)
+	fmt.Fprintf(&sb, "_%s_\n", r.description())
+	for _, rw := range rows {
+		fmt.Fprintf(&sb, "• %s\n", rw)
+	}
+	return sb.String()
+}
+
+func updateMessage(state *alertState, rows []row) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Still firing after %s:\n", state.LastSeen.Sub(state.FiringSince).Round(time.Second))
+	for _, rw := range rows {
+		fmt.Fprintf(&sb, "• %s\n", rw)
+	}
+	return sb.String()
+}
+
+func resolvedMessage(r *rule, state *alertState, now time.Time) string {
+	return fmt.Sprintf(":white_check_mark: *Rule `%s` resolved for `%s`* after %s.",
+		r.Name, state.Key, now.Sub(state.FiringSince).Round(time.Second))
+}
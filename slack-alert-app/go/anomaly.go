@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+)
+
+// Anomaly detection methods.
+const (
+	// anomalyZScore compares the value to the mean and standard deviation of the window before
+	// it.
+	anomalyZScore = "zscore"
+	// anomalySeasonal compares the value to the values at the same time of the previous
+	// seasons, such as the same hour of the previous weeks.
+	anomalySeasonal = "seasonal"
+)
+
+// Samples around the same time of the previous seasons that are part of a seasonal baseline.
+const seasonalTolerance = 30 * time.Minute
+
+// anomaly makes a rule fire on the rows whose value deviates from its history, rather than on
+// a static threshold. The rule's condition, if any, selects the rows that are checked, such as
+// those with enough requests.
+type anomaly struct {
+	// Value is an expression over the numeric columns, such as
+	// `error_count / total_requests`.
+	Value  string `yaml:"value"`
+	Method string `yaml:"method"`
+	// Window is how far back the z-score baseline goes. It defaults to 24 hours.
+	Window time.Duration `yaml:"window"`
+	// Season is the period of the seasonal baseline. It defaults to a week.
+	Season time.Duration `yaml:"season"`
+	// Threshold is the number of standard deviations from the baseline that is anomalous. It
+	// defaults to 3.
+	Threshold float64 `yaml:"threshold"`
+	// Direction is `up` (the default) to only alert on increases, `down` or `both`.
+	Direction string `yaml:"direction"`
+	// MinSamples is the number of samples the baseline needs before alerting. It defaults to
+	// 12 for z-scores and 3 for seasonal baselines.
+	MinSamples int `yaml:"min_samples"`
+	// MinDeviation is the smallest absolute difference from the baseline that is anomalous, to
+	// ignore the noise of very stable values.
+	MinDeviation float64 `yaml:"min_deviation"`
+
+	program *vm.Program
+}
+
+// anomalyResult describes how a row deviates from its baseline. ZScore is infinite when the
+// baseline is constant.
+type anomalyResult struct {
+	Current  float64
+	Baseline float64
+	StdDev   float64
+	ZScore   float64
+	Samples  int
+}
+
+func (a *anomalyResult) String() string {
+	if math.IsInf(a.ZScore, 0) {
+		return fmt.Sprintf("current %s, baseline %s (constant over %d samples)",
+			formatNumber(a.Current), formatNumber(a.Baseline), a.Samples)
+	}
+	return fmt.Sprintf("current %s, baseline %s ± %s (z-score %.1f over %d samples)",
+		formatNumber(a.Current), formatNumber(a.Baseline), formatNumber(a.StdDev), a.ZScore, a.Samples)
+}
+
+// fields returns the result as notification fields. JSON has no infinity, so the z-score is
+// left out for constant baselines.
+func (a *anomalyResult) fields() map[string]interface{} {
+	f := map[string]interface{}{
+		"current":  a.Current,
+		"baseline": a.Baseline,
+		"stddev":   a.StdDev,
+		"samples":  a.Samples,
+	}
+	if !math.IsInf(a.ZScore, 0) {
+		f["zscore"] = a.ZScore
+	}
+	return f
+}
+
+func (a *anomaly) compile() error {
+	if a.Method == "" {
+		a.Method = anomalyZScore
+	}
+	if a.Method != anomalyZScore && a.Method != anomalySeasonal {
+		return fmt.Errorf("unknown anomaly method %q", a.Method)
+	}
+	if a.Window == 0 {
+		a.Window = 24 * time.Hour
+	}
+	if a.Season == 0 {
+		a.Season = 7 * 24 * time.Hour
+	}
+	if a.Window < 0 || a.Window > historyRetention || a.Season < 0 || a.Season > historyRetention/2 {
+		return fmt.Errorf("the anomaly window and season must fit in the %s history", historyRetention)
+	}
+	if a.Threshold == 0 {
+		a.Threshold = 3
+	}
+	if a.Direction == "" {
+		a.Direction = "up"
+	}
+	if a.Direction != "up" && a.Direction != "down" && a.Direction != "both" {
+		return fmt.Errorf("invalid anomaly direction %q", a.Direction)
+	}
+	if a.MinSamples == 0 {
+		a.MinSamples = 12
+		if a.Method == anomalySeasonal {
+			a.MinSamples = 3
+		}
+	}
+	program, err := expr.Compile(a.Value, expr.AllowUndefinedVariables())
+	if err != nil {
+		return fmt.Errorf("anomaly value: %v", err)
+	}
+	a.program = program
+	return nil
+}
+
+// value evaluates the anomaly value on a row's columns or a sample. ok is false when it isn't a
+// finite number, such as a ratio with no requests.
+func (a *anomaly) value(env map[string]interface{}) (float64, bool, error) {
+	out, err := expr.Run(a.program, env)
+	if err != nil {
+		return 0, false, err
+	}
+	var v float64
+	switch out := out.(type) {
+	case float64:
+		v = out
+	case int:
+		v = float64(out)
+	case nil:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("anomaly value returned %T, not a number", out)
+	}
+	return v, !math.IsNaN(v) && !math.IsInf(v, 0), nil
+}
+
+// baselineSamples returns the samples the current value of a row is compared to.
+func (a *anomaly) baselineSamples(h *historyStore, series, id string, now time.Time) ([]sample, error) {
+	if a.Method == anomalyZScore {
+		return h.samples(series, id, now.Add(-a.Window), now)
+	}
+	var samples []sample
+	for t := now.Add(-a.Season); now.Sub(t) <= historyRetention; t = t.Add(-a.Season) {
+		s, err := h.samples(series, id, t.Add(-seasonalTolerance), t.Add(seasonalTolerance))
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s...)
+	}
+	return samples, nil
+}
+
+// detect returns the rows that deviate from their baseline in the series' history, annotated
+// with the deviation.
+func (a *anomaly) detect(h *historyStore, series string, rows []row, now time.Time) ([]row, error) {
+	var anomalies []row
+	for _, rw := range rows {
+		current, ok, err := a.value(rw.env())
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		samples, err := a.baselineSamples(h, series, rowID(rw), now)
+		if err != nil {
+			return nil, err
+		}
+		var values []float64
+		for _, s := range samples {
+			v, ok, err := a.value(s.values)
+			if err == nil && ok {
+				values = append(values, v)
+			}
+		}
+		if len(values) < a.MinSamples {
+			continue
+		}
+		mean, stddev := meanStdDev(values)
+		diff := current - mean
+		if math.Abs(diff) < a.MinDeviation || diff == 0 {
+			continue
+		}
+		z := math.Inf(1)
+		if stddev > 0 {
+			z = math.Abs(diff) / stddev
+		}
+		if z < a.Threshold || (a.Direction == "up" && diff < 0) || (a.Direction == "down" && diff > 0) {
+			continue
+		}
+		if diff < 0 {
+			z = -z
+		}
+		rw.anomaly = &anomalyResult{Current: current, Baseline: mean, StdDev: stddev, ZScore: z, Samples: len(values)}
+		anomalies = append(anomalies, rw)
+	}
+	return anomalies, nil
+}
+
+func meanStdDev(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var sq float64
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(values)))
+}
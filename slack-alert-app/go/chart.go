@@ -0,0 +1,322 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// chartConfig attaches a time-series chart to a rule's alerts, from a windowed PxL script
+// such as the error rate per minute over the last hour. The script is run with the values of
+// the alert's key columns as variables, such as `service`, to chart the alerting service.
+type chartConfig struct {
+	// Script is the path of the PxL script.
+	Script string `yaml:"script"`
+	// Vars are defined as PxL variables along with the key columns.
+	Vars map[string]string `yaml:"vars"`
+	// Table is the output table charted. It defaults to the first one.
+	Table string `yaml:"table"`
+	// Time is the time column. It defaults to `time_`.
+	Time string `yaml:"time"`
+	// Value is an expression over the columns, such as `error_count / total_requests`.
+	Value string `yaml:"value"`
+	// Title defaults to the value expression.
+	Title string `yaml:"title"`
+	// CSV also attaches the table as a CSV file.
+	CSV bool `yaml:"csv"`
+
+	pxl     string
+	program *vm.Program
+}
+
+func (c *chartConfig) load() error {
+	if c.Time == "" {
+		c.Time = "time_"
+	}
+	if c.Title == "" {
+		c.Title = c.Value
+	}
+	program, err := expr.Compile(c.Value, expr.AllowUndefinedVariables())
+	if err != nil {
+		return fmt.Errorf("chart value: %v", err)
+	}
+	c.program = program
+	b, err := ioutil.ReadFile(c.Script)
+	if err != nil {
+		return fmt.Errorf("chart: %v", err)
+	}
+	c.pxl = string(b)
+	return nil
+}
+
+// How long the chart script of an alert can run.
+const chartTimeout = 30 * time.Second
+
+// attachment is a file sent along with an alert.
+type attachment struct {
+	Filename string
+	Title    string
+	Data     []byte
+}
+
+// alertAttachments runs the chart script of a new alert and returns the chart, and the CSV of
+// the table if configured. The alert is sent without them if the script fails.
+func (jr *jobRunner) alertAttachments(ctx context.Context, r *rule, key string, rows []row) []attachment {
+	c := r.Chart
+	if c == nil || len(rows) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, chartTimeout)
+	defer cancel()
+
+	vars := make(map[string]string, len(c.Vars))
+	for name, v := range c.Vars {
+		vars[name] = v
+	}
+	columns := r.Key
+	if len(columns) == 0 {
+		columns = stringColumns(rows[0].metadata)
+	}
+	for _, col := range columns {
+		if v, ok := rows[0].value(col).(string); ok {
+			vars[col] = v
+		}
+	}
+
+	tm, err := executeScript(ctx, jr.vz, fmt.Sprintf("Chart of rule %q", r.Name), scriptWithVars(c.pxl, vars))
+	if err != nil {
+		log.Printf("Chart of rule %q failed: %v\n", r.Name, err)
+		return nil
+	}
+	name := c.Table
+	if name == "" && len(tm.names) > 0 {
+		name = tm.names[0]
+	}
+	table, err := tm.waitTable(ctx, name)
+	if err != nil {
+		log.Printf("Chart of rule %q failed: %v\n", r.Name, err)
+		return nil
+	}
+
+	var points []chartPoint
+	for _, rw := range table.rows {
+		t, ok := rw.value(c.Time).(time.Time)
+		if !ok {
+			continue
+		}
+		out, err := expr.Run(c.program, rw.env())
+		if err != nil {
+			log.Printf("Chart of rule %q failed: %v\n", r.Name, err)
+			return nil
+		}
+		if v, ok := out.(float64); ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			points = append(points, chartPoint{t: t, v: v})
+		}
+	}
+
+	var attachments []attachment
+	title := fmt.Sprintf("%s for %s", c.Title, key)
+	if len(points) > 0 {
+		img, err := renderChart(title, points)
+		if err != nil {
+			log.Printf("Chart of rule %q failed: %v\n", r.Name, err)
+		} else {
+			attachments = append(attachments, attachment{Filename: r.Name + ".png", Title: title, Data: img})
+		}
+	}
+	if c.CSV {
+		data, err := tableCSV(table)
+		if err != nil {
+			log.Printf("CSV of rule %q failed: %v\n", r.Name, err)
+		} else {
+			attachments = append(attachments, attachment{Filename: r.Name + ".csv", Title: name, Data: data})
+		}
+	}
+	return attachments
+}
+
+// tableCSV writes a table as CSV, with the column names as header.
+func tableCSV(table *tableCollector) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := make([]string, len(table.metadata.ColInfo))
+	for i, col := range table.metadata.ColInfo {
+		header[i] = col.Name
+	}
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, rw := range table.rows {
+		record := make([]string, len(header))
+		for i, col := range header {
+			if d := rw.record.GetDatum(col); d != nil {
+				record[i] = d.String()
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+type chartPoint struct {
+	t time.Time
+	v float64
+}
+
+// Size and margins of the charts, in pixels.
+const (
+	chartWidth   = 640
+	chartHeight  = 240
+	chartLeft    = 56
+	chartRight   = 16
+	chartTop     = 28
+	chartBottom  = 24
+	chartYLabels = 4
+)
+
+var (
+	chartBackground = color.White
+	chartAxis       = color.Gray{Y: 0x80}
+	chartGrid       = color.Gray{Y: 0xe0}
+	chartLine       = color.RGBA{R: 0xd6, G: 0x27, B: 0x28, A: 0xff}
+	chartText       = color.Gray{Y: 0x30}
+)
+
+// renderChart draws the points as a line chart, with the value range on the Y axis and the
+// time range on the X axis, and encodes it as PNG.
+func renderChart(title string, points []chartPoint) ([]byte, error) {
+	sort.Slice(points, func(i, j int) bool { return points[i].t.Before(points[j].t) })
+	minV, maxV := 0.0, points[0].v
+	for _, p := range points {
+		minV = math.Min(minV, p.v)
+		maxV = math.Max(maxV, p.v)
+	}
+	if maxV == minV {
+		maxV = minV + 1
+	}
+	start, end := points[0].t, points[len(points)-1].t
+	span := end.Sub(start)
+	if span == 0 {
+		span = time.Minute
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+	plotW := chartWidth - chartLeft - chartRight
+	plotH := chartHeight - chartTop - chartBottom
+	x := func(t time.Time) int {
+		return chartLeft + int(float64(plotW)*float64(t.Sub(start))/float64(span))
+	}
+	y := func(v float64) int {
+		return chartTop + plotH - int(float64(plotH)*(v-minV)/(maxV-minV))
+	}
+
+	drawText(img, 4, 16, truncate(title, (chartWidth-8)/7), chartText)
+	for i := 0; i <= chartYLabels; i++ {
+		v := minV + (maxV-minV)*float64(i)/chartYLabels
+		gy := y(v)
+		drawLine(img, chartLeft, gy, chartWidth-chartRight, gy, chartGrid)
+		label := truncate(formatNumber(v), (chartLeft-8)/7)
+		drawText(img, chartLeft-6-7*len([]rune(label)), gy+4, label, chartText)
+	}
+	drawLine(img, chartLeft, chartTop, chartLeft, chartTop+plotH, chartAxis)
+	drawLine(img, chartLeft, chartTop+plotH, chartWidth-chartRight, chartTop+plotH, chartAxis)
+	startLabel := start.UTC().Format("15:04")
+	endLabel := end.UTC().Format("15:04 UTC")
+	drawText(img, chartLeft, chartHeight-6, startLabel, chartText)
+	drawText(img, chartWidth-chartRight-7*len(endLabel), chartHeight-6, endLabel, chartText)
+
+	for i := 1; i < len(points); i++ {
+		x0, y0 := x(points[i-1].t), y(points[i-1].v)
+		x1, y1 := x(points[i].t), y(points[i].v)
+		// Draw the line 2 pixels thick.
+		drawLine(img, x0, y0, x1, y1, chartLine)
+		drawLine(img, x0, y0+1, x1, y1+1, chartLine)
+	}
+	if len(points) == 1 {
+		p := points[0]
+		draw.Draw(img, image.Rect(x(p.t)-2, y(p.v)-2, x(p.t)+3, y(p.v)+3), image.NewUniform(chartLine), image.Point{}, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a line with Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// drawText draws s with its baseline at y, in a 7x13 pixels bitmap font.
+func drawText(img *image.RGBA, x, y int, s string, c color.Color) {
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: basicfont.Face7x13, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+}
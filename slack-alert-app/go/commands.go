@@ -0,0 +1,407 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+	"px.dev/pxapi"
+)
+
+// commandsConfig lists the scripts that can be run from Slack with the `/pixie` slash command,
+// for example:
+//
+//	/pixie run http_errors namespace=px-sock-shop
+//	/pixie top-errors 10m
+//
+// A bare duration such as `10m` given as the `start_time` means that long ago, `-10m`.
+type commandsConfig struct {
+	// Channels are the channels the scripts can be run from, unless they list their own. They
+	// are channel IDs, or names with or without the leading `#`.
+	Channels []string         `yaml:"channels"`
+	Scripts  []*commandScript `yaml:"scripts"`
+}
+
+// commandScript is a script allowed to run from Slack.
+type commandScript struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Script is the path of the PxL script.
+	Script string `yaml:"script"`
+	// Args names the variables set by the positional arguments of the command, in order.
+	Args []string `yaml:"args"`
+	// Vars are the default values of the variables. The command can only set the variables
+	// listed here or in Args, with `name=value` arguments.
+	Vars     map[string]string `yaml:"vars"`
+	Channels []string          `yaml:"channels"`
+
+	pxl string
+}
+
+var commandNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Commands of the bot itself, which scripts can't be named after.
+var builtinCommands = map[string]bool{"run": true, "help": true, "silences": true}
+
+// PxL variable names.
+var varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// load checks the command's settings and reads its script.
+func (s *commandScript) load(defaultChannels []string) error {
+	if !commandNameRe.MatchString(s.Name) || builtinCommands[s.Name] {
+		return fmt.Errorf("invalid command name %q", s.Name)
+	}
+	for _, name := range s.Args {
+		if !varNameRe.MatchString(name) {
+			return fmt.Errorf("command %q: invalid variable name %q", s.Name, name)
+		}
+	}
+	for name := range s.Vars {
+		if !varNameRe.MatchString(name) {
+			return fmt.Errorf("command %q: invalid variable name %q", s.Name, name)
+		}
+	}
+	if len(s.Channels) == 0 {
+		s.Channels = defaultChannels
+	}
+	if len(s.Channels) == 0 {
+		return fmt.Errorf("command %q: no channels allowed to run it", s.Name)
+	}
+	b, err := ioutil.ReadFile(s.Script)
+	if err != nil {
+		return fmt.Errorf("command %q: %v", s.Name, err)
+	}
+	s.pxl = string(b)
+	return nil
+}
+
+// allowed returns whether the command can be run from the channel.
+func (s *commandScript) allowed(channelID, channelName string) bool {
+	return channelAllowed(s.Channels, channelID, channelName)
+}
+
+// channelAllowed returns whether the channel is one of channels.
+func channelAllowed(channels []string, channelID, channelName string) bool {
+	for _, c := range channels {
+		c = strings.TrimPrefix(c, "#")
+		if c == channelID || c == channelName {
+			return true
+		}
+	}
+	return false
+}
+
+// vars returns the script variables given the command arguments.
+func (s *commandScript) vars(args []string) (map[string]string, error) {
+	vars := make(map[string]string, len(s.Vars)+len(s.Args))
+	for name, v := range s.Vars {
+		vars[name] = v
+	}
+	allowed := make(map[string]bool)
+	for _, name := range s.Args {
+		allowed[name] = true
+	}
+	for name := range s.Vars {
+		allowed[name] = true
+	}
+	positional := 0
+	for _, arg := range args {
+		if i := strings.Index(arg, "="); i > 0 {
+			name := arg[:i]
+			if !allowed[name] {
+				return nil, fmt.Errorf("`%s` doesn't take `%s`", s.Name, name)
+			}
+			vars[name] = arg[i+1:]
+			continue
+		}
+		if positional >= len(s.Args) {
+			return nil, fmt.Errorf("too many arguments for `%s`", s.Name)
+		}
+		vars[s.Args[positional]] = arg
+		positional++
+	}
+	for _, name := range s.Args {
+		if _, ok := vars[name]; !ok {
+			return nil, fmt.Errorf("missing `%s` argument", name)
+		}
+	}
+	if v, ok := vars[startTimeVar]; ok && durationRe.MatchString(v) {
+		vars[startTimeVar] = "-" + v
+	}
+	return vars, nil
+}
+
+// Variable of the start of the window the scripts query, such as `-10m`.
+const startTimeVar = "start_time"
+
+// Durations such as `10m`, which PxL only takes as relative start times when negative.
+var durationRe = regexp.MustCompile(`^[0-9]+(ns|us|ms|s|m|h|d)$`)
+
+// usage describes how to run the command.
+func (s *commandScript) usage() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "`/pixie %s", s.Name)
+	for _, name := range s.Args {
+		fmt.Fprintf(&sb, " <%s>", name)
+	}
+	names := make([]string, 0, len(s.Vars))
+	for name := range s.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, " [%s=%s]", name, s.Vars[name])
+	}
+	sb.WriteString("`")
+	if s.Description != "" {
+		sb.WriteString(": " + s.Description)
+	}
+	return sb.String()
+}
+
+// How long a command's script can run.
+const commandTimeout = 2 * time.Minute
+
+// commandHandler answers the slash commands and the clicks on the alert buttons received over
+// Socket Mode.
+type commandHandler struct {
+	client *socketmode.Client
+	// ack acknowledges the requests received over Socket Mode.
+	ack     func(req socketmode.Request, payload ...interface{})
+	api     *slack.Client
+	vz      *pxapi.VizierClient
+	scripts map[string]*commandScript
+	// channels are the default channels of the scripts.
+	channels []string
+	alerts   *alertTracker
+}
+
+func newCommandHandler(api *slack.Client, vz *pxapi.VizierClient, config commandsConfig, alerts *alertTracker) *commandHandler {
+	h := &commandHandler{
+		client:   socketmode.New(api),
+		api:      api,
+		vz:       vz,
+		scripts:  make(map[string]*commandScript),
+		channels: config.Channels,
+		alerts:   alerts,
+	}
+	h.ack = h.client.Ack
+	for _, s := range config.Scripts {
+		h.scripts[s.Name] = s
+	}
+	return h
+}
+
+// run connects to Slack and handles the slash commands until the connection fails for good.
+func (h *commandHandler) run(ctx context.Context) error {
+	go h.handleEvents(ctx)
+	return h.client.Run()
+}
+
+func (h *commandHandler) handleEvents(ctx context.Context) {
+	for evt := range h.client.Events {
+		switch evt.Type {
+		case socketmode.EventTypeConnecting:
+			log.Println("Connecting to Slack with Socket Mode.")
+		case socketmode.EventTypeConnectionError:
+			log.Printf("Socket Mode connection failed: %v\n", evt.Data)
+		case socketmode.EventTypeConnected:
+			log.Println("Connected to Slack with Socket Mode.")
+		case socketmode.EventTypeSlashCommand:
+			cmd, ok := evt.Data.(slack.SlashCommand)
+			if !ok {
+				continue
+			}
+			h.handle(ctx, evt.Request, cmd)
+		case socketmode.EventTypeInteractive:
+			callback, ok := evt.Data.(slack.InteractionCallback)
+			if !ok {
+				continue
+			}
+			h.ack(*evt.Request)
+			if callback.Type == slack.InteractionTypeBlockActions {
+				go h.handleActions(ctx, callback)
+			}
+		}
+	}
+}
+
+// ephemeral is an acknowledgement payload only shown to the user who ran the command.
+func ephemeral(text string) map[string]interface{} {
+	return map[string]interface{}{"response_type": "ephemeral", "text": text}
+}
+
+// handle acknowledges a slash command, then runs its script and replies in a thread.
+func (h *commandHandler) handle(ctx context.Context, req *socketmode.Request, cmd slack.SlashCommand) {
+	fields := strings.Fields(cmd.Text)
+	if len(fields) > 0 && fields[0] == "run" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || fields[0] == "help" {
+		h.ack(*req, ephemeral(h.help(cmd)))
+		return
+	}
+	if fields[0] == "silences" && h.silencesAllowed(cmd) {
+		h.ack(*req, ephemeral(h.alerts.silencesMessage()))
+		return
+	}
+	s, ok := h.scripts[fields[0]]
+	if !ok || !s.allowed(cmd.ChannelID, cmd.ChannelName) {
+		h.ack(*req, ephemeral(fmt.Sprintf("Unknown command `%s` in this channel.\n%s", fields[0], h.help(cmd))))
+		return
+	}
+	vars, err := s.vars(fields[1:])
+	if err != nil {
+		h.ack(*req, ephemeral(fmt.Sprintf("%s. Usage: %s", err.Error(), s.usage())))
+		return
+	}
+	h.ack(*req)
+	log.Printf("User %s ran %q in #%s.\n", cmd.UserName, cmd.Text, cmd.ChannelName)
+
+	go func() {
+		if err := h.execute(ctx, cmd, s, vars); err != nil {
+			log.Printf("Command %q failed: %v\n", cmd.Text, err)
+		}
+	}()
+}
+
+// help lists the commands that can be run from the channel.
+func (h *commandHandler) help(cmd slack.SlashCommand) string {
+	var lines []string
+	for _, s := range h.scripts {
+		if s.allowed(cmd.ChannelID, cmd.ChannelName) {
+			lines = append(lines, "• "+s.usage())
+		}
+	}
+	sort.Strings(lines)
+	if h.silencesAllowed(cmd) {
+		lines = append(lines, "• `/pixie silences`: the silenced alerts.")
+	}
+	if len(lines) == 0 {
+		return "No commands are available in this channel."
+	}
+	return "Commands available in this channel:\n" + strings.Join(lines, "\n")
+}
+
+// silencesAllowed returns whether the silences can be listed from the channel: one of the
+// default channels, or of the channels of a script.
+func (h *commandHandler) silencesAllowed(cmd slack.SlashCommand) bool {
+	if channelAllowed(h.channels, cmd.ChannelID, cmd.ChannelName) {
+		return true
+	}
+	for _, s := range h.scripts {
+		if s.allowed(cmd.ChannelID, cmd.ChannelName) {
+			return true
+		}
+	}
+	return false
+}
+
+// execute announces the command in the channel, runs its script and replies with the output
+// tables in the announcement's thread.
+func (h *commandHandler) execute(ctx context.Context, cmd slack.SlashCommand, s *commandScript, vars map[string]string) error {
+	api := h.api
+	text := fmt.Sprintf("<@%s> ran `%s %s`", cmd.UserID, cmd.Command, cmd.Text)
+	_, ts, err := api.PostMessageContext(ctx, cmd.ChannelID, slack.MsgOptionText(text, false))
+	if err != nil {
+		return err
+	}
+	reply := func(text string) error {
+		_, _, err := api.PostMessageContext(ctx, cmd.ChannelID, slack.MsgOptionText(text, false), slack.MsgOptionTS(ts))
+		return err
+	}
+
+	// The replies are still posted when the script times out.
+	scriptCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	tm, err := executeScript(scriptCtx, h.vz, fmt.Sprintf("Command %q", cmd.Text), scriptWithVars(s.pxl, vars))
+	if err != nil {
+		if replyErr := reply(fmt.Sprintf(":x: The script failed: %s", err.Error())); replyErr != nil {
+			return replyErr
+		}
+		return err
+	}
+	if len(tm.names) == 0 {
+		return reply("The script didn't output any table.")
+	}
+	for _, name := range tm.names {
+		table, err := tm.waitTable(scriptCtx, name)
+		if err != nil {
+			return reply(fmt.Sprintf(":x: %s", err.Error()))
+		}
+		if err := postTable(ctx, api, cmd.ChannelID, name, table, slack.MsgOptionTS(ts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleActions acknowledges or silences the alert whose button was clicked, and replies in the
+// alert's thread.
+func (h *commandHandler) handleActions(ctx context.Context, callback slack.InteractionCallback) {
+	channel := callback.Container.ChannelID
+	if channel == "" {
+		channel = callback.Channel.ID
+	}
+	thread := callback.Message.ThreadTimestamp
+	if thread == "" {
+		thread = callback.Container.MessageTs
+	}
+	user := fmt.Sprintf("<@%s>", callback.User.ID)
+	for _, action := range callback.ActionCallback.BlockActions {
+		var a alertAction
+		if action.ActionID != actionAcknowledge && action.ActionID != actionSilence {
+			continue
+		}
+		if err := json.Unmarshal([]byte(action.Value), &a); err != nil {
+			log.Printf("Invalid alert action %q: %v\n", action.Value, err)
+			continue
+		}
+		var text string
+		switch action.ActionID {
+		case actionAcknowledge:
+			if err := h.alerts.acknowledge(a.Rule, a.Key, user); err != nil {
+				text = fmt.Sprintf("Couldn't acknowledge the alert: %s", err.Error())
+			} else {
+				text = fmt.Sprintf(":eyes: %s acknowledged the alert. Updates are paused until it resolves.", user)
+			}
+		case actionSilence:
+			s, err := h.alerts.silence(a.Rule, a.Key, user, buttonSilenceDuration)
+			if err != nil {
+				text = fmt.Sprintf("Couldn't silence the alert: %s", err.Error())
+			} else {
+				text = fmt.Sprintf(":no_bell: %s silenced the alert until %s (silence %s).",
+					user, s.EndsAt.UTC().Format(time.RFC3339), s.ID)
+			}
+		}
+		log.Printf("Alert %s: %s\n", alertID(a.Rule, a.Key), text)
+		_, _, err := h.api.PostMessageContext(ctx, channel, slack.MsgOptionText(text, false), slack.MsgOptionTS(thread))
+		if err != nil {
+			log.Printf("Failed to reply to the alert action: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// fakeSlack is a Slack API server recording the messages posted to it.
+type fakeSlack struct {
+	*httptest.Server
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+type fakeMessage struct {
+	channel, text, threadTS string
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/chat.postMessage" {
+			t.Errorf("unexpected Slack API call %s", req.URL.Path)
+			http.NotFound(w, req)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("invalid form: %v", err)
+		}
+		f.mu.Lock()
+		f.messages = append(f.messages, fakeMessage{
+			channel:  req.Form.Get("channel"),
+			text:     req.Form.Get("text"),
+			threadTS: req.Form.Get("thread_ts"),
+		})
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "channel": req.Form.Get("channel"), "ts": "1600000000.000200"})
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// ack is an acknowledgement of a Socket Mode request.
+type ack struct {
+	envelopeID string
+	payload    interface{}
+}
+
+// newTestCommandHandler returns a handler talking to a fake Slack, which records the
+// acknowledgements it sends.
+func newTestCommandHandler(t *testing.T) (*commandHandler, *fakeSlack, *[]ack) {
+	f := newFakeSlack(t)
+	tracker, err := loadAlertTracker(filepath.Join(t.TempDir(), "alert-state.json"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := commandsConfig{
+		Channels: []string{"#pixie-alerts"},
+		Scripts: []*commandScript{
+			{
+				Name:     "top-errors",
+				Args:     []string{"start_time"},
+				Vars:     map[string]string{"namespace": "px-sock-shop"},
+				Channels: []string{"#pixie-alerts"},
+			},
+			{
+				Name:     "oncall-errors",
+				Args:     []string{"start_time"},
+				Channels: []string{"C0ONCALL"},
+			},
+		},
+	}
+	api := slack.New("xoxb-test", slack.OptionAPIURL(f.URL+"/"))
+	h := newCommandHandler(api, nil, config, tracker)
+	var acks []ack
+	h.ack = func(req socketmode.Request, payload ...interface{}) {
+		a := ack{envelopeID: req.EnvelopeID}
+		if len(payload) > 0 {
+			a.payload = payload[0]
+		}
+		acks = append(acks, a)
+	}
+	return h, f, &acks
+}
+
+func TestCommandScriptVars(t *testing.T) {
+	s := &commandScript{
+		Name: "top-errors",
+		Args: []string{"start_time"},
+		Vars: map[string]string{"namespace": "px-sock-shop"},
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "positional",
+			args: []string{"-10m"},
+			want: map[string]string{"start_time": "-10m", "namespace": "px-sock-shop"},
+		},
+		{
+			name: "bare duration",
+			args: []string{"10m"},
+			want: map[string]string{"start_time": "-10m", "namespace": "px-sock-shop"},
+		},
+		{
+			name: "named bare duration",
+			args: []string{"start_time=1h", "namespace=default"},
+			want: map[string]string{"start_time": "-1h", "namespace": "default"},
+		},
+		{
+			name: "absolute time",
+			args: []string{"2022-03-01T09:00:00Z"},
+			want: map[string]string{"start_time": "2022-03-01T09:00:00Z", "namespace": "px-sock-shop"},
+		},
+		{
+			name:    "unknown variable",
+			args:    []string{"-10m", "pod=carts"},
+			wantErr: "`top-errors` doesn't take `pod`",
+		},
+		{
+			name:    "too many arguments",
+			args:    []string{"-10m", "-5m"},
+			wantErr: "too many arguments for `top-errors`",
+		},
+		{
+			name:    "missing argument",
+			args:    []string{"namespace=default"},
+			wantErr: "missing `start_time` argument",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.vars(tc.args)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("vars(%q) = %v, %v, want error %q", tc.args, got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("vars(%q) = %v, want %v", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleChannelACL(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		channelID   string
+		channelName string
+		want        string
+	}{
+		{"silences in default channel", "silences", "C0ALERTS", "pixie-alerts", "No alerts are silenced."},
+		{"silences in script channel", "silences", "C0ONCALL", "oncall", "No alerts are silenced."},
+		{"silences elsewhere", "silences", "C0RANDOM", "random", "Unknown command `silences` in this channel."},
+		{"script elsewhere", "top-errors 10m", "C0RANDOM", "random", "Unknown command `top-errors` in this channel."},
+		{"script of another channel", "oncall-errors 10m", "C0ALERTS", "pixie-alerts", "Unknown command `oncall-errors` in this channel."},
+		{"help elsewhere", "help", "C0RANDOM", "random", "No commands are available in this channel."},
+		{"help", "", "C0ALERTS", "pixie-alerts", "Commands available in this channel:\n• `/pixie top-errors <start_time> [namespace=px-sock-shop]`\n• `/pixie silences`: the silenced alerts."},
+		{"invalid arguments", "run top-errors 10m 5m", "C0ALERTS", "pixie-alerts", "too many arguments for `top-errors`."},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f, acks := newTestCommandHandler(t)
+			req := &socketmode.Request{EnvelopeID: "envelope"}
+			cmd := slack.SlashCommand{Command: "/pixie", Text: tc.text, ChannelID: tc.channelID, ChannelName: tc.channelName, UserName: "alice"}
+			h.handle(context.Background(), req, cmd)
+			if len(*acks) != 1 {
+				t.Fatalf("got %d acknowledgements, want 1", len(*acks))
+			}
+			payload, ok := (*acks)[0].payload.(map[string]interface{})
+			if !ok {
+				t.Fatalf("acknowledgement without a reply: %+v", (*acks)[0])
+			}
+			if payload["response_type"] != "ephemeral" {
+				t.Errorf("response_type = %v, want ephemeral", payload["response_type"])
+			}
+			if text, _ := payload["text"].(string); !strings.HasPrefix(text, tc.want) {
+				t.Errorf("reply = %q, want it to start with %q", text, tc.want)
+			}
+			if len(f.messages) != 0 {
+				t.Errorf("posted %v, want only an ephemeral reply", f.messages)
+			}
+		})
+	}
+}
+
+func alertButton(t *testing.T, actionID string, a alertAction) *slack.BlockAction {
+	value, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &slack.BlockAction{ActionID: actionID, Value: string(value)}
+}
+
+func TestHandleActions(t *testing.T) {
+	h, f, _ := newTestCommandHandler(t)
+	h.alerts.alerts[alertID("high-error-rate", "service=carts")] = &alertState{Rule: "high-error-rate", Key: "service=carts"}
+
+	callback := slack.InteractionCallback{
+		Type:      slack.InteractionTypeBlockActions,
+		User:      slack.User{ID: "U0ALICE"},
+		Container: slack.Container{ChannelID: "C0ALERTS", MessageTs: "1600000000.000100"},
+	}
+	callback.ActionCallback.BlockActions = []*slack.BlockAction{
+		alertButton(t, actionAcknowledge, alertAction{Rule: "high-error-rate", Key: "service=carts"}),
+		alertButton(t, actionSilence, alertAction{Rule: "high-error-rate", Key: "service=carts"}),
+		alertButton(t, actionAcknowledge, alertAction{Rule: "high-error-rate", Key: "service=orders"}),
+		{ActionID: actionSilence, Value: "not json"},
+		{ActionID: "other", Value: "{}"},
+	}
+	h.handleActions(context.Background(), callback)
+
+	state := h.alerts.alerts[alertID("high-error-rate", "service=carts")]
+	if state.AckedBy != "<@U0ALICE>" {
+		t.Errorf("AckedBy = %q, want <@U0ALICE>", state.AckedBy)
+	}
+	if len(h.alerts.silences) != 1 {
+		t.Fatalf("got %d silences, want 1", len(h.alerts.silences))
+	}
+	if s := h.alerts.silences[0]; s.Rule != "high-error-rate" || s.Key != "service=carts" || s.CreatedBy != "<@U0ALICE>" {
+		t.Errorf("silence = %+v, want one of service=carts by <@U0ALICE>", s)
+	}
+
+	wantPrefixes := []string{
+		":eyes: <@U0ALICE> acknowledged the alert.",
+		":no_bell: <@U0ALICE> silenced the alert until ",
+		"Couldn't acknowledge the alert: the alert is no longer firing",
+	}
+	if len(f.messages) != len(wantPrefixes) {
+		t.Fatalf("posted %d messages, want %d: %v", len(f.messages), len(wantPrefixes), f.messages)
+	}
+	for i, m := range f.messages {
+		if m.channel != "C0ALERTS" || m.threadTS != "1600000000.000100" {
+			t.Errorf("message %d posted in %s thread %s, want the alert's thread", i, m.channel, m.threadTS)
+		}
+		if !strings.HasPrefix(m.text, wantPrefixes[i]) {
+			t.Errorf("message %d = %q, want it to start with %q", i, m.text, wantPrefixes[i])
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config is the bot's configuration file: the PxL scripts it runs, the rules evaluated on their
+// output, where the alerts are sent, when they are silenced and the scripts that can be run
+// from Slack.
+type config struct {
+	Notifiers []notifierConfig `yaml:"notifiers"`
+	Rules     []*rule          `yaml:"rules"`
+	Jobs      []*job           `yaml:"jobs"`
+	Commands  commandsConfig   `yaml:"commands"`
+	// Maintenance lists the windows during which alerts are silenced.
+	Maintenance []*maintenanceWindow `yaml:"maintenance"`
+	Routing     routingConfig        `yaml:"routing"`
+}
+
+// Notifier the rules send their alerts to by default. Unless the config file configures it, it
+// posts to the #pixie-alerts channel.
+const defaultNotifier = "slack"
+
+var defaultNotifierConfig = notifierConfig{Name: defaultNotifier, Type: notifierSlack, Channel: "#pixie-alerts"}
+
+// Job run when the config file doesn't define any: the HTTP errors script of the px-sock-shop
+// namespace, every 5 minutes, evaluating all the rules.
+var defaultJob = job{
+	Name:     "http-errors",
+	Script:   "http_errors.pxl",
+	Vars:     map[string]string{"namespace": "px-sock-shop"},
+	Schedule: "@every 5m",
+}
+
+// loadConfig reads the config file, and loads the scripts and compiles the rules it references.
+// Relative script paths are resolved from the working directory.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	notifiers := make(map[string]bool)
+	for _, n := range c.Notifiers {
+		if n.Name == "" || notifiers[n.Name] {
+			return nil, fmt.Errorf("%s: notifiers need a unique name", path)
+		}
+		notifiers[n.Name] = true
+	}
+	if !notifiers[defaultNotifier] {
+		c.Notifiers = append(c.Notifiers, defaultNotifierConfig)
+		notifiers[defaultNotifier] = true
+	}
+
+	rules := make(map[string]*rule)
+	for _, r := range c.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%s: rule without a name", path)
+		}
+		if rules[r.Name] != nil {
+			return nil, fmt.Errorf("%s: duplicate rule %q", path, r.Name)
+		}
+		rules[r.Name] = r
+		if err := r.compile(notifiers); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if len(c.Jobs) == 0 {
+		if len(c.Rules) == 0 {
+			return nil, fmt.Errorf("%s: no jobs or rules defined", path)
+		}
+		j := defaultJob
+		for _, r := range c.Rules {
+			j.Rules = append(j.Rules, r.Name)
+		}
+		c.Jobs = []*job{&j}
+	}
+	jobs := make(map[string]bool)
+	// Alerts are identified by rule, so each rule is evaluated by a single job.
+	ruleJobs := make(map[string]string)
+	for _, j := range c.Jobs {
+		if j.Name == "" || jobs[j.Name] {
+			return nil, fmt.Errorf("%s: jobs need a unique name", path)
+		}
+		jobs[j.Name] = true
+		for _, name := range j.Rules {
+			if rules[name] == nil {
+				return nil, fmt.Errorf("%s: job %q: unknown rule %q", path, j.Name, name)
+			}
+			if other, ok := ruleJobs[name]; ok {
+				return nil, fmt.Errorf("%s: rule %q is used by jobs %q and %q", path, name, other, j.Name)
+			}
+			ruleJobs[name] = j.Name
+			j.rules = append(j.rules, rules[name])
+		}
+		if err := j.load(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, r := range c.Rules {
+		if _, ok := ruleJobs[r.Name]; !ok {
+			return nil, fmt.Errorf("%s: rule %q isn't used by any job", path, r.Name)
+		}
+	}
+
+	if err := c.Routing.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, m := range c.Maintenance {
+		if err := m.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, name := range m.Rules {
+			if rules[name] == nil {
+				return nil, fmt.Errorf("%s: maintenance window %q: unknown rule %q", path, m.Name, name)
+			}
+		}
+	}
+
+	commands := make(map[string]bool)
+	for _, s := range c.Commands.Scripts {
+		if commands[s.Name] {
+			return nil, fmt.Errorf("%s: duplicate command %q", path, s.Name)
+		}
+		commands[s.Name] = true
+		if err := s.load(c.Commands.Channels); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return &c, nil
+}
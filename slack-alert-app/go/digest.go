@@ -0,0 +1,449 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// digest makes a job post a summary of each namespace over a period, rather than tables or
+// alerts: the services with the most errors, the slowest endpoints, the traffic growth of the
+// services since the previous digest, and the new services. It runs several PxL scripts and
+// merges their output tables by name, so that a script for another protocol can add its
+// services or endpoints.
+type digest struct {
+	// Period is the time covered by each digest, such as 24h or 168h. It should match the
+	// job's schedule, as the traffic is compared with that of the previous digest. It defaults
+	// to 24 hours.
+	Period time.Duration `yaml:"period"`
+	// Namespaces lists the namespaces summarized. It defaults to all of them.
+	Namespaces []string `yaml:"namespaces"`
+	// Scripts are the paths of the PxL scripts, which are given the `start_time` of the
+	// period as a variable along with the job's vars. They output `services` tables, with the
+	// `namespace`, `service`, `total_requests` and `error_count` columns, and `endpoints`
+	// tables, with the `namespace`, `service`, `req_path`, `total_requests` and `latency_p99`
+	// columns. They default to digest_services.pxl and digest_endpoints.pxl.
+	Scripts []string `yaml:"scripts"`
+	// Top is the number of services or endpoints listed in each section. It defaults to 5.
+	Top int `yaml:"top"`
+	// MinRequests is the number of requests over the period that a service or endpoint needs
+	// to be ranked, so that a handful of failed or slow requests don't top the lists. It
+	// defaults to 10, and can be set to 0 to rank them all.
+	MinRequests *float64 `yaml:"min_requests"`
+
+	pxl         []string
+	minRequests float64
+}
+
+const (
+	defaultDigestPeriod      = 24 * time.Hour
+	defaultDigestTop         = 5
+	defaultDigestMinRequests = 10
+)
+
+var defaultDigestScripts = []string{"digest_services.pxl", "digest_endpoints.pxl"}
+
+// Output tables of the digest scripts.
+const (
+	digestServicesTable  = "services"
+	digestEndpointsTable = "endpoints"
+)
+
+// load reads the digest's scripts, defining the job's vars and the start of the period.
+func (d *digest) load(vars map[string]string) error {
+	if d.Period == 0 {
+		d.Period = defaultDigestPeriod
+	}
+	if d.Period < time.Minute {
+		return fmt.Errorf("digest: invalid period %s", d.Period)
+	}
+	if d.Top == 0 {
+		d.Top = defaultDigestTop
+	}
+	if d.Top < 0 {
+		return fmt.Errorf("digest: invalid top %d", d.Top)
+	}
+	d.minRequests = defaultDigestMinRequests
+	if d.MinRequests != nil {
+		d.minRequests = *d.MinRequests
+	}
+	if d.minRequests < 0 {
+		return fmt.Errorf("digest: invalid min_requests %s", formatNumber(d.minRequests))
+	}
+	if len(d.Scripts) == 0 {
+		d.Scripts = append([]string(nil), defaultDigestScripts...)
+	}
+
+	scriptVars := make(map[string]string, len(vars)+1)
+	for name, v := range vars {
+		scriptVars[name] = v
+	}
+	scriptVars["start_time"] = "-" + formatPeriod(d.Period)
+	d.pxl = nil
+	for _, script := range d.Scripts {
+		b, err := ioutil.ReadFile(script)
+		if err != nil {
+			return fmt.Errorf("digest: %v", err)
+		}
+		d.pxl = append(d.pxl, scriptWithVars(string(b), scriptVars))
+	}
+	return nil
+}
+
+// formatPeriod prints a period without its zero minutes and seconds, such as `24h` or `1h30m`,
+// as PxL expects.
+func formatPeriod(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// digestService is the traffic of a service over the period, summed across the rows of the
+// services tables.
+type digestService struct {
+	namespace string
+	service   string
+	requests  float64
+	errors    float64
+	// previous is the requests of the previous digest, if the service was part of it.
+	previous *float64
+	// new is set when the service isn't part of the history of the digest.
+	new bool
+}
+
+func (s *digestService) id() string {
+	return fmt.Sprintf("namespace=%s,service=%s", s.namespace, s.service)
+}
+
+// runDigest runs the digest's scripts, posts a summary of each namespace in the job's channel
+// and records the traffic of the services for the next digest.
+func (jr *jobRunner) runDigest(ctx context.Context, j *job) error {
+	d := j.Digest
+	tables := make(map[string]*tableCollector)
+	for i, pxl := range d.pxl {
+		log.Printf("Job %q: executing PxL script %s.\n", j.Name, d.Scripts[i])
+		tm, err := executeScript(ctx, jr.vz, fmt.Sprintf("Job %q", j.Name), pxl)
+		if err != nil {
+			return fmt.Errorf("%s: %v", d.Scripts[i], err)
+		}
+		for _, name := range tm.names {
+			table, err := tm.waitTable(ctx, name)
+			if err != nil {
+				return fmt.Errorf("%s: %v", d.Scripts[i], err)
+			}
+			// The rows keep the metadata of their own table, so tables with different columns
+			// can be merged.
+			if merged, ok := tables[name]; ok {
+				merged.rows = append(merged.rows, table.rows...)
+			} else {
+				tables[name] = table
+			}
+		}
+	}
+	if tables[digestServicesTable] == nil && tables[digestEndpointsTable] == nil {
+		return fmt.Errorf("the scripts did not output a %q or %q table", digestServicesTable, digestEndpointsTable)
+	}
+
+	now := time.Now()
+	series := historySeries(j, digestServicesTable)
+	hasHistory, err := jr.history.hasSeries(series)
+	if err != nil {
+		return err
+	}
+	services := digestServices(tables[digestServicesTable])
+	if hasHistory {
+		for _, s := range services {
+			samples, err := jr.history.samples(series, s.id(), now.Add(-historyRetention), now)
+			if err != nil {
+				return err
+			}
+			s.new = len(samples) == 0
+			// The previous digest ran about a period ago.
+			for _, smp := range samples {
+				v, ok := smp.values["total_requests"].(float64)
+				if ok && smp.time.After(now.Add(-2*d.Period)) && smp.time.Before(now.Add(-d.Period/2)) {
+					s.previous = &v
+				}
+			}
+		}
+	}
+	var endpoints []row
+	if t := tables[digestEndpointsTable]; t != nil {
+		endpoints = t.rows
+	}
+
+	namespaces := d.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = digestNamespaces(services, endpoints)
+	}
+	var errs []string
+	for _, ns := range namespaces {
+		m := d.render(ns, services, endpoints, hasHistory)
+		_, _, err := jr.slackClient.PostMessageContext(ctx, j.Channel,
+			slack.MsgOptionText(m.Text, false), slack.MsgOptionBlocks(m.Blocks...), slack.MsgOptionAsUser(true))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("posting the digest of %s: %v", ns, err))
+		}
+	}
+
+	values := make(map[string]map[string]float64, len(services))
+	for _, s := range services {
+		values[s.id()] = map[string]float64{"total_requests": s.requests, "error_count": s.errors}
+	}
+	if err := jr.history.recordValues(series, values, now); err != nil {
+		errs = append(errs, fmt.Sprintf("recording the services: %v", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// digestServices sums the traffic of each service across the rows of the services tables,
+// in namespace and service order.
+func digestServices(table *tableCollector) []*digestService {
+	if table == nil {
+		return nil
+	}
+	byID := make(map[string]*digestService)
+	var services []*digestService
+	for _, rw := range table.rows {
+		s := &digestService{namespace: stringValue(rw, "namespace"), service: stringValue(rw, "service")}
+		if existing, ok := byID[s.id()]; ok {
+			s = existing
+		} else {
+			byID[s.id()] = s
+			services = append(services, s)
+		}
+		s.requests += floatValue(rw, "total_requests")
+		s.errors += floatValue(rw, "error_count")
+	}
+	sort.Slice(services, func(i, k int) bool {
+		if services[i].namespace != services[k].namespace {
+			return services[i].namespace < services[k].namespace
+		}
+		return services[i].service < services[k].service
+	})
+	return services
+}
+
+// digestNamespaces returns the namespaces of the services and endpoints, in order.
+func digestNamespaces(services []*digestService, endpoints []row) []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	add := func(ns string) {
+		if ns != "" && !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	for _, s := range services {
+		add(s.namespace)
+	}
+	for _, rw := range endpoints {
+		add(stringValue(rw, "namespace"))
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func stringValue(rw row, column string) string {
+	s, _ := rw.value(column).(string)
+	return s
+}
+
+func floatValue(rw row, column string) float64 {
+	f, _ := rw.value(column).(float64)
+	return f
+}
+
+// render formats the digest of a namespace as a message: the totals of the period, then a
+// section per list.
+func (d *digest) render(ns string, services []*digestService, endpoints []row, hasHistory bool) tableMessage {
+	var inNamespace []*digestService
+	var requests, errors float64
+	for _, s := range services {
+		if s.namespace == ns {
+			inNamespace = append(inNamespace, s)
+			requests += s.requests
+			errors += s.errors
+		}
+	}
+
+	title := fmt.Sprintf("Digest of %s", ns)
+	switch d.Period {
+	case 24 * time.Hour:
+		title = fmt.Sprintf("Daily digest of %s", ns)
+	case 7 * 24 * time.Hour:
+		title = fmt.Sprintf("Weekly digest of %s", ns)
+	}
+	summary := fmt.Sprintf("Over the last %s: %s HTTP requests to %d services, %s errors.",
+		formatPeriod(d.Period), formatNumber(requests), len(inNamespace), formatPercent(errors, requests))
+
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, truncate(title, maxHeaderTextLen), false, false)),
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, summary, false, false)),
+	}
+	section := func(heading string, lines []string, empty string) {
+		text := fmt.Sprintf("*%s*\n", heading)
+		if len(lines) == 0 {
+			text += fmt.Sprintf("_%s_", empty)
+		} else {
+			text += strings.Join(lines, "\n")
+		}
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, truncate(text, maxSectionTextLen), false, false), nil, nil))
+	}
+	noHistory := "No previous digest to compare with."
+
+	section("Top error services", d.topErrors(ns, inNamespace), "No errors.")
+	section("Slowest endpoints (p99 latency)", d.slowestEndpoints(ns, endpoints), "No endpoints.")
+	if hasHistory {
+		section("Traffic growth since the previous digest", d.trafficGrowth(ns, inNamespace), "No services to compare.")
+		section("New services", d.newServices(ns, inNamespace), "No new services.")
+	} else {
+		section("Traffic growth since the previous digest", nil, noHistory)
+		section("New services", nil, noHistory)
+	}
+	return tableMessage{Text: title, Blocks: blocks}
+}
+
+// serviceName strips the namespace from Pixie's `namespace/name` service names.
+func serviceName(ns, service string) string {
+	return strings.TrimPrefix(service, ns+"/")
+}
+
+func formatPercent(v, total float64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return formatNumber(math.Round(v/total*1000)/10) + "%"
+}
+
+// topErrors lists the services with the highest error rates.
+func (d *digest) topErrors(ns string, services []*digestService) []string {
+	var ranked []*digestService
+	for _, s := range services {
+		if s.errors > 0 && s.requests >= d.minRequests {
+			ranked = append(ranked, s)
+		}
+	}
+	sort.SliceStable(ranked, func(i, k int) bool {
+		return ranked[i].errors/ranked[i].requests > ranked[k].errors/ranked[k].requests
+	})
+	var lines []string
+	for _, s := range ranked {
+		if len(lines) == d.Top {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• `%s`: %s errors, %s of %s requests",
+			serviceName(ns, s.service), formatPercent(s.errors, s.requests), formatNumber(s.errors), formatNumber(s.requests)))
+	}
+	return lines
+}
+
+// slowestEndpoints lists the endpoints with the highest 99th percentile latency.
+func (d *digest) slowestEndpoints(ns string, endpoints []row) []string {
+	var ranked []row
+	for _, rw := range endpoints {
+		if stringValue(rw, "namespace") == ns && floatValue(rw, "total_requests") >= d.minRequests {
+			ranked = append(ranked, rw)
+		}
+	}
+	sort.SliceStable(ranked, func(i, k int) bool {
+		return floatValue(ranked[i], "latency_p99") > floatValue(ranked[k], "latency_p99")
+	})
+	var lines []string
+	for _, rw := range ranked {
+		if len(lines) == d.Top {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• `%s` `%s`: %s, %s requests",
+			serviceName(ns, stringValue(rw, "service")), truncate(stringValue(rw, "req_path"), maxCellWidth),
+			formatDuration(floatValue(rw, "latency_p99")), formatNumber(floatValue(rw, "total_requests"))))
+	}
+	return lines
+}
+
+// trafficGrowth lists the services whose requests changed the most since the previous digest,
+// relatively.
+func (d *digest) trafficGrowth(ns string, services []*digestService) []string {
+	var ranked []*digestService
+	for _, s := range services {
+		// The services without requests in the previous digest have no growth rate.
+		if s.previous != nil && *s.previous > 0 && *s.previous >= d.minRequests {
+			ranked = append(ranked, s)
+		}
+	}
+	growth := func(s *digestService) float64 {
+		return s.requests / *s.previous - 1
+	}
+	sort.SliceStable(ranked, func(i, k int) bool {
+		return math.Abs(growth(ranked[i])) > math.Abs(growth(ranked[k]))
+	})
+	var lines []string
+	for _, s := range ranked {
+		if len(lines) == d.Top {
+			break
+		}
+		g := math.Round(growth(s)*1000) / 10
+		sign := "+"
+		if g < 0 {
+			sign = "−"
+		}
+		lines = append(lines, fmt.Sprintf("• `%s`: %s%s%%, %s → %s requests",
+			serviceName(ns, s.service), sign, formatNumber(math.Abs(g)), formatNumber(*s.previous), formatNumber(s.requests)))
+	}
+	return lines
+}
+
+// newServices lists the services that aren't part of the history of the digest, by traffic.
+func (d *digest) newServices(ns string, services []*digestService) []string {
+	var ranked []*digestService
+	for _, s := range services {
+		if s.new {
+			ranked = append(ranked, s)
+		}
+	}
+	sort.SliceStable(ranked, func(i, k int) bool {
+		return ranked[i].requests > ranked[k].requests
+	})
+	var lines []string
+	for _, s := range ranked {
+		if len(lines) == d.Top {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• `%s`: %s requests", serviceName(ns, s.service), formatNumber(s.requests)))
+	}
+	if len(ranked) > d.Top {
+		lines = append(lines, fmt.Sprintf("_and %d more._", len(ranked)-d.Top))
+	}
+	return lines
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/errdefs"
+)
+
+// Script executions failing with transient errors, such as a Vizier restart or a dropped
+// stream, are retried with exponential backoff.
+const (
+	executeAttempts = 3
+	executeBackoff  = 2 * time.Second
+)
+
+// executeScript runs a PxL script and streams its results. It returns once the results have
+// been received, or the last attempt or the context failed.
+func executeScript(ctx context.Context, vz *pxapi.VizierClient, name, pxl string) (*tableMux, error) {
+	backoff := executeBackoff
+	for attempt := 1; ; attempt++ {
+		tm, err := executeScriptOnce(ctx, vz, pxl)
+		if err == nil {
+			return tm, nil
+		}
+		if attempt == executeAttempts || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("%s: attempt %d failed, retrying in %s: %v\n", name, attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func executeScriptOnce(ctx context.Context, vz *pxapi.VizierClient, pxl string) (*tableMux, error) {
+	tm := &tableMux{tables: make(map[string]*tableCollector)}
+	resultSet, err := vz.ExecuteScript(ctx, pxl, tm)
+	if err != nil {
+		return nil, fmt.Errorf("executing script: %w", err)
+	}
+	defer resultSet.Close()
+	if err := resultSet.Stream(); err != nil {
+		return nil, fmt.Errorf("streaming results: %w", err)
+	}
+	return tm, nil
+}
+
+// retryable returns whether err may go away by running the script again. Invalid scripts and
+// credentials won't.
+func retryable(err error) bool {
+	return !errors.Is(err, errdefs.ErrCompilation) && !errors.Is(err, errdefs.ErrUnauthenticated)
+}
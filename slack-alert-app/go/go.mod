@@ -3,6 +3,11 @@ module slackbot
 go 1.15
 
 require (
+	github.com/antonmedv/expr v1.9.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/slack-go/slack v0.8.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/image v0.5.0
+	gopkg.in/yaml.v2 v2.4.0
 	px.dev/pxapi v0.0.0-20210429075727-90459acf9e37
 )
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// How long the samples are kept. It covers two weeks, for the weekly seasonal baselines.
+const historyRetention = 15 * 24 * time.Hour
+
+// historyStore keeps the history of the numeric columns of the jobs' output tables, in an
+// embedded bbolt database. The samples are organized in buckets by series, the job and table
+// they come from, then by row, identified by the row's string columns such as `service`, and
+// keyed by time.
+type historyStore struct {
+	db *bbolt.DB
+}
+
+func openHistoryStore(path string) (*historyStore, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &historyStore{db: db}, nil
+}
+
+func (h *historyStore) Close() error {
+	return h.db.Close()
+}
+
+// sample is the values of a row's numeric columns at some time.
+type sample struct {
+	time   time.Time
+	values map[string]interface{}
+}
+
+// ID of the rows of tables without string columns, which are a single series. bbolt doesn't
+// accept empty bucket names.
+const singleRowID = "_"
+
+// rowID identifies a row among those of its table by the values of its string columns.
+func rowID(rw row) string {
+	columns := stringColumns(rw.metadata)
+	if len(columns) == 0 {
+		return singleRowID
+	}
+	fields := make([]string, len(columns))
+	for i, col := range columns {
+		fields[i] = fmt.Sprintf("%s=%v", col, rw.value(col))
+	}
+	return strings.Join(fields, ",")
+}
+
+func stringColumns(metadata *types.TableMetadata) []string {
+	var columns []string
+	for _, col := range metadata.ColInfo {
+		if col.Type == vizierpb.STRING {
+			columns = append(columns, col.Name)
+		}
+	}
+	return columns
+}
+
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+// record saves the rows of a table as samples of the series at time now, and drops the
+// samples older than the retention.
+func (h *historyStore) record(series string, rows []row, now time.Time) error {
+	values := make(map[string]map[string]float64, len(rows))
+	for _, rw := range rows {
+		v := make(map[string]float64)
+		for _, col := range rw.metadata.ColInfo {
+			if f, ok := rw.value(col.Name).(float64); ok {
+				v[col.Name] = f
+			}
+		}
+		values[rowID(rw)] = v
+	}
+	return h.recordValues(series, values, now)
+}
+
+// recordValues saves the values of the rows, by row ID, as samples of the series at time now,
+// and drops the samples older than the retention.
+func (h *historyStore) recordValues(series string, values map[string]map[string]float64, now time.Time) error {
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(series))
+		if err != nil {
+			return err
+		}
+		for id, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			rb, err := b.CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return err
+			}
+			if err := rb.Put(timeKey(now), data); err != nil {
+				return err
+			}
+		}
+		return prune(b, now.Add(-historyRetention))
+	})
+}
+
+// hasSeries returns whether samples of the series have been recorded.
+func (h *historyStore) hasSeries(series string) (bool, error) {
+	var ok bool
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		ok = tx.Bucket([]byte(series)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// prune deletes the samples older than cutoff, and the rows left without samples.
+func prune(b *bbolt.Bucket, cutoff time.Time) error {
+	var empty [][]byte
+	err := b.ForEach(func(id, _ []byte) error {
+		rb := b.Bucket(id)
+		if rb == nil {
+			return nil
+		}
+		c := rb.Cursor()
+		min := timeKey(cutoff)
+		for k, _ := c.First(); k != nil && bytes.Compare(k, min) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		if k, _ := c.First(); k == nil {
+			empty = append(empty, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range empty {
+		if err := b.DeleteBucket(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samples returns the samples of a row of the series between from and to.
+func (h *historyStore) samples(series, id string, from, to time.Time) ([]sample, error) {
+	var samples []sample
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(series))
+		if b == nil {
+			return nil
+		}
+		rb := b.Bucket([]byte(id))
+		if rb == nil {
+			return nil
+		}
+		c := rb.Cursor()
+		max := timeKey(to)
+		for k, v := c.Seek(timeKey(from)); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			var values map[string]interface{}
+			if err := json.Unmarshal(v, &values); err != nil {
+				return err
+			}
+			samples = append(samples, sample{
+				time:   time.Unix(0, int64(binary.BigEndian.Uint64(k))),
+				values: values,
+			})
+		}
+		return nil
+	})
+	return samples, err
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/slack-go/slack"
+	"px.dev/pxapi"
+)
+
+// job runs a PxL script on a schedule, posts some of its output tables to a Slack channel and
+// evaluates rules on them, or posts a digest.
+type job struct {
+	Name string `yaml:"name"`
+	// Script is the path of the PxL script.
+	Script string `yaml:"script"`
+	// Vars are defined as PxL variables at the top of the script, such as
+	// `namespace = "px-sock-shop"`.
+	Vars map[string]string `yaml:"vars"`
+	// Schedule is a cron expression, such as `*/5 * * * *` or `@every 5m`.
+	Schedule string `yaml:"schedule"`
+	// Tables lists the output tables posted in Channel on each run.
+	Tables  []string `yaml:"tables"`
+	Channel string   `yaml:"channel"`
+	// Route posts the rows of the tables in the channels of the teams owning their services,
+	// and only those without an owner in Channel.
+	Route bool `yaml:"route"`
+	// Rules lists the rules evaluated on the output.
+	Rules []string `yaml:"rules"`
+	// Timeout bounds each run, including the retries of the script. It defaults to 2 minutes.
+	Timeout time.Duration `yaml:"timeout"`
+	// Digest makes the job post a summary of each namespace in Channel, from the digest's
+	// scripts rather than Script.
+	Digest *digest `yaml:"digest"`
+
+	pxl   string
+	rules []*rule
+	// historyTables are the tables of the anomaly rules, whose history is recorded.
+	historyTables []string
+	// failing is set while the runs fail, to only report the first failure. The runs of a job
+	// don't overlap.
+	failing bool
+}
+
+const defaultJobTimeout = 2 * time.Minute
+
+// load reads the job's script and checks its settings.
+func (j *job) load() error {
+	if _, err := cron.ParseStandard(j.Schedule); err != nil {
+		return fmt.Errorf("job %q: invalid schedule %q: %v", j.Name, j.Schedule, err)
+	}
+	if j.Timeout == 0 {
+		j.Timeout = defaultJobTimeout
+	}
+	if j.Timeout < 0 {
+		return fmt.Errorf("job %q: invalid timeout %s", j.Name, j.Timeout)
+	}
+	if j.Digest != nil {
+		if j.Script != "" || len(j.Tables) > 0 || len(j.Rules) > 0 || j.Route {
+			return fmt.Errorf("job %q: a digest job has no script, tables, rules or routing", j.Name)
+		}
+		if j.Channel == "" {
+			return fmt.Errorf("job %q: a channel is required to post the digest", j.Name)
+		}
+		if err := j.Digest.load(j.Vars); err != nil {
+			return fmt.Errorf("job %q: %v", j.Name, err)
+		}
+		return nil
+	}
+	if len(j.Tables) > 0 && j.Channel == "" {
+		return fmt.Errorf("job %q: a channel is required to post tables", j.Name)
+	}
+	if len(j.Tables) == 0 && len(j.Rules) == 0 {
+		return fmt.Errorf("job %q: no tables or rules", j.Name)
+	}
+	tables := make(map[string]bool)
+	for _, r := range j.rules {
+		if r.Anomaly != nil && !tables[r.Table] {
+			tables[r.Table] = true
+			j.historyTables = append(j.historyTables, r.Table)
+		}
+	}
+	b, err := ioutil.ReadFile(j.Script)
+	if err != nil {
+		return fmt.Errorf("job %q: %v", j.Name, err)
+	}
+	j.pxl = scriptWithVars(string(b), j.Vars)
+	return nil
+}
+
+// scriptWithVars prepends the variable definitions to the script, in name order.
+func scriptWithVars(pxl string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return pxl
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s = %s\n", name, strconv.QuoteToASCII(vars[name]))
+	}
+	sb.WriteString(pxl)
+	return sb.String()
+}
+
+// jobRunner runs the jobs with the clients they share.
+type jobRunner struct {
+	vz          *pxapi.VizierClient
+	slackClient *slack.Client
+	alerts      *alertTracker
+	history     *historyStore
+	router      *router
+	// errorChannel is where the failures of the jobs without a channel are reported.
+	errorChannel string
+}
+
+// run executes the job's script once, posts its tables and updates the alerts of its rules, or
+// posts its digest, within the job's timeout.
+func (jr *jobRunner) run(ctx context.Context, j *job) error {
+	ctx, cancel := context.WithTimeout(ctx, j.Timeout)
+	defer cancel()
+	if j.Digest != nil {
+		return jr.runDigest(ctx, j)
+	}
+
+	log.Printf("Job %q: executing PxL script.\n", j.Name)
+	tm, err := executeScript(ctx, jr.vz, fmt.Sprintf("Job %q", j.Name), j.pxl)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, name := range j.Tables {
+		table, err := tm.waitTable(ctx, name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		title := fmt.Sprintf("%s: %s", j.Name, name)
+		if !j.Route {
+			if err := postTable(ctx, jr.slackClient, j.Channel, title, table); err != nil {
+				errs = append(errs, fmt.Sprintf("posting table %q: %v", name, err))
+			}
+			continue
+		}
+		byChannel, channels := jr.router.fanOut(ctx, table.rows, j.Channel)
+		for _, channel := range channels {
+			part := &tableCollector{metadata: table.metadata, rows: byChannel[channel]}
+			if err := postTable(ctx, jr.slackClient, channel, title, part); err != nil {
+				errs = append(errs, fmt.Sprintf("posting table %q in %s: %v", name, channel, err))
+			}
+		}
+	}
+
+	// Update the alerts of each rule from the table data.
+	now := time.Now()
+	for _, r := range j.rules {
+		table, err := tm.waitTable(ctx, r.Table)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("rule %q: %v", r.Name, err))
+			continue
+		}
+		matches, err := r.match(table)
+		if err == nil && r.Anomaly != nil {
+			matches, err = r.Anomaly.detect(jr.history, historySeries(j, r.Table), matches, now)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := jr.alerts.update(ctx, r, matches); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// Record the tables of the anomaly rules once they have been compared to their history.
+	for _, name := range j.historyTables {
+		table, err := tm.waitTable(ctx, name)
+		if err != nil {
+			continue
+		}
+		if err := jr.history.record(historySeries(j, name), table.rows, now); err != nil {
+			errs = append(errs, fmt.Sprintf("recording table %q: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// historySeries names the history of a job's output table.
+func historySeries(j *job, table string) string {
+	return j.Name + "/" + table
+}
+
+// runAndReport runs the job, turning panics into errors. It reports in Slack when the job
+// starts failing and when it recovers, rather than on every failed run.
+func (jr *jobRunner) runAndReport(ctx context.Context, j *job) {
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return jr.run(ctx, j)
+	}()
+
+	var msg string
+	switch {
+	case err != nil:
+		log.Printf("Job %q failed: %v\n", j.Name, err)
+		if !j.failing {
+			msg = fmt.Sprintf(":warning: *Job `%s` failed:* %s", j.Name, err.Error())
+		}
+	case j.failing:
+		log.Printf("Job %q recovered.\n", j.Name)
+		msg = fmt.Sprintf(":white_check_mark: *Job `%s` recovered.*", j.Name)
+	}
+	j.failing = err != nil
+
+	channel := j.Channel
+	if channel == "" {
+		channel = jr.errorChannel
+	}
+	if msg == "" || channel == "" {
+		return
+	}
+	// The job's deadline may have expired, so the report gets its own.
+	reportCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if _, _, err := jr.slackClient.PostMessageContext(reportCtx, channel, slack.MsgOptionText(msg, false), slack.MsgOptionAsUser(true)); err != nil {
+		log.Printf("Job %q: failed to report in %s: %v\n", j.Name, channel, err)
+	}
+}
+
+// postTable renders a table and posts it in the channel, with the given message options such as
+// the thread to reply in.
+func postTable(ctx context.Context, client *slack.Client, channel, title string, table *tableCollector, opts ...slack.MsgOption) error {
+	for _, m := range renderTable(title, &table.metadata, table.rows) {
+		msgOpts := append([]slack.MsgOption{
+			slack.MsgOptionText(m.Text, false), slack.MsgOptionBlocks(m.Blocks...), slack.MsgOptionAsUser(true),
+		}, opts...)
+		_, _, err := client.PostMessageContext(ctx, channel, msgOpts...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedule adds the jobs to a scheduler. Each job runs on its own: a failing or panicking job
+// doesn't affect the others, and a run is skipped while the previous one is still going.
+func (jr *jobRunner) schedule(ctx context.Context, jobs []*job) (*cron.Cron, error) {
+	logger := cron.VerbosePrintfLogger(log.New(os.Stderr, "", log.LstdFlags))
+	c := cron.New()
+	for _, j := range jobs {
+		j := j
+		run := cron.NewChain(cron.SkipIfStillRunning(logger)).Then(cron.FuncJob(func() {
+			jr.runAndReport(ctx, j)
+		}))
+		if _, err := c.AddJob(j.Schedule, run); err != nil {
+			return nil, fmt.Errorf("job %q: %v", j.Name, err)
+		}
+		// Run the jobs once at startup rather than waiting for their first slot, except for the
+		// digests, which cover the period since the previous one.
+		if j.Digest == nil {
+			go run.Run()
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,464 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Alert lifecycle events.
+const (
+	eventFiring   = "firing"
+	eventUpdate   = "update"
+	eventResolved = "resolved"
+)
+
+// notification is an alert lifecycle event sent to the notifiers.
+type notification struct {
+	Event     string `json:"event"`
+	Rule      string `json:"rule"`
+	Key       string `json:"key"`
+	Condition string `json:"condition"`
+	// Title and Text are the rendered message, in Slack's mrkdwn format.
+	Title       string                   `json:"title"`
+	Text        string                   `json:"text"`
+	Rows        []map[string]interface{} `json:"rows,omitempty"`
+	FiringSince time.Time                `json:"firing_since"`
+	// Ref is what the notifier returned for the firing event of the same alert, such as the
+	// Slack thread to reply in. It is empty for firing events.
+	Ref string `json:"-"`
+	// Attachments are files sent along with firing events, such as a chart.
+	Attachments []attachment `json:"-"`
+	// Channel overrides the channel of the Slack notifiers, to route the alert to its owner.
+	Channel string `json:"-"`
+}
+
+// notifier sends alert notifications to a destination.
+type notifier interface {
+	// notify sends n and returns the reference to pass along with the later events of the same
+	// alert.
+	notify(ctx context.Context, n notification) (string, error)
+}
+
+// Notifier types.
+const (
+	notifierSlack     = "slack"
+	notifierWebhook   = "webhook"
+	notifierPagerDuty = "pagerduty"
+	notifierTeams     = "teams"
+	notifierSMTP      = "smtp"
+)
+
+// Default PagerDuty Events API v2 endpoint.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// notifierConfig configures a notifier in the rules file. Values of the form `${VAR}` are
+// read from the environment, to keep secrets out of the file.
+type notifierConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Channel is the Slack channel to post in.
+	Channel string `yaml:"channel"`
+	// URL is the endpoint of the webhook, PagerDuty and Teams notifiers.
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// RoutingKey and Severity configure the PagerDuty events.
+	RoutingKey string `yaml:"routing_key"`
+	Severity   string `yaml:"severity"`
+	// SMTP server and envelope of the email notifier.
+	SMTPAddr string   `yaml:"smtp_addr"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// newNotifier creates the notifier described by c. Slack notifiers share the bot's client, and
+// add Acknowledge and Silence buttons to the alerts when interactive.
+func newNotifier(c notifierConfig, slackClient *slack.Client, interactive bool) (notifier, error) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	switch c.Type {
+	case notifierSlack:
+		if c.Channel == "" {
+			return nil, fmt.Errorf("notifier %q: channel is required", c.Name)
+		}
+		return &slackNotifier{client: slackClient, channel: c.Channel, interactive: interactive}, nil
+	case notifierWebhook:
+		if c.URL == "" {
+			return nil, fmt.Errorf("notifier %q: url is required", c.Name)
+		}
+		headers := make(map[string]string, len(c.Headers))
+		for k, v := range c.Headers {
+			headers[k] = os.ExpandEnv(v)
+		}
+		return &webhookNotifier{httpClient: httpClient, url: os.ExpandEnv(c.URL), headers: headers}, nil
+	case notifierPagerDuty:
+		n := &pagerDutyNotifier{
+			httpClient: httpClient,
+			url:        os.ExpandEnv(c.URL),
+			routingKey: os.ExpandEnv(c.RoutingKey),
+			severity:   c.Severity,
+		}
+		if n.url == "" {
+			n.url = pagerDutyEventsURL
+		}
+		if n.routingKey == "" {
+			return nil, fmt.Errorf("notifier %q: routing_key is required", c.Name)
+		}
+		if n.severity == "" {
+			n.severity = "error"
+		}
+		return n, nil
+	case notifierTeams:
+		if c.URL == "" {
+			return nil, fmt.Errorf("notifier %q: url is required", c.Name)
+		}
+		return &teamsNotifier{httpClient: httpClient, url: os.ExpandEnv(c.URL)}, nil
+	case notifierSMTP:
+		if c.SMTPAddr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("notifier %q: smtp_addr, from and to are required", c.Name)
+		}
+		return &smtpNotifier{
+			addr:     os.ExpandEnv(c.SMTPAddr),
+			username: os.ExpandEnv(c.Username),
+			password: os.ExpandEnv(c.Password),
+			from:     c.From,
+			to:       c.To,
+		}, nil
+	}
+	return nil, fmt.Errorf("notifier %q: unknown type %q", c.Name, c.Type)
+}
+
+// slackNotifier posts a message when an alert fires, and replies in its thread for the updates
+// and the resolution.
+type slackNotifier struct {
+	client  *slack.Client
+	channel string
+	// interactive is set when the bot receives the button clicks, over Socket Mode.
+	interactive bool
+}
+
+// Action IDs of the alert buttons.
+const (
+	actionAcknowledge = "alert_acknowledge"
+	actionSilence     = "alert_silence"
+)
+
+// How long the Silence button silences an alert.
+const buttonSilenceDuration = time.Hour
+
+// alertAction is the value of the alert buttons.
+type alertAction struct {
+	Rule string `json:"rule"`
+	Key  string `json:"key"`
+}
+
+func (s *slackNotifier) notify(ctx context.Context, n notification) (string, error) {
+	channel := s.channel
+	if n.Channel != "" {
+		channel = n.Channel
+	}
+	opts := []slack.MsgOption{slack.MsgOptionText(n.Text, false), slack.MsgOptionAsUser(true)}
+	if s.interactive && n.Event == eventFiring {
+		value, err := json.Marshal(alertAction{Rule: n.Rule, Key: n.Key})
+		if err != nil {
+			return "", err
+		}
+		opts = append(opts, slack.MsgOptionBlocks(
+			slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, truncate(n.Text, maxSectionTextLen), false, false), nil, nil),
+			slack.NewActionBlock("",
+				slack.NewButtonBlockElement(actionAcknowledge, string(value), slack.NewTextBlockObject(slack.PlainTextType, "Acknowledge", false, false)),
+				slack.NewButtonBlockElement(actionSilence, string(value), slack.NewTextBlockObject(slack.PlainTextType, "Silence for 1h", false, false)),
+			),
+		))
+	}
+	if n.Ref != "" {
+		opts = append(opts, slack.MsgOptionTS(n.Ref))
+		if n.Event == eventResolved {
+			// Show the resolution in the channel too.
+			opts = append(opts, slack.MsgOptionBroadcast())
+		}
+	}
+	_, ts, err := s.client.PostMessageContext(ctx, channel, opts...)
+	if err != nil {
+		return "", err
+	}
+	if n.Ref != "" {
+		return n.Ref, nil
+	}
+	// The attachments go in the alert's thread. The alert was posted, so failing to upload
+	// them doesn't fail the notification.
+	for _, a := range n.Attachments {
+		_, err := s.client.UploadFileContext(ctx, slack.FileUploadParameters{
+			Reader:          bytes.NewReader(a.Data),
+			Filename:        a.Filename,
+			Title:           a.Title,
+			Channels:        []string{channel},
+			ThreadTimestamp: ts,
+		})
+		if err != nil {
+			log.Printf("Failed to upload %s: %v\n", a.Filename, err)
+		}
+	}
+	return ts, nil
+}
+
+// postJSON posts body as JSON and fails on non-2xx responses.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// webhookNotifier posts every notification as JSON to a URL.
+type webhookNotifier struct {
+	httpClient *http.Client
+	url        string
+	headers    map[string]string
+}
+
+func (w *webhookNotifier) notify(ctx context.Context, n notification) (string, error) {
+	return "", postJSON(ctx, w.httpClient, w.url, w.headers, n)
+}
+
+// pagerDutyNotifier triggers and resolves PagerDuty incidents through the Events API v2. The
+// alert's rule and key are the dedup key, so the incident resolves along with the alert.
+type pagerDutyNotifier struct {
+	httpClient *http.Client
+	url        string
+	routingKey string
+	severity   string
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Component     string                 `json:"component,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+func (p *pagerDutyNotifier) notify(ctx context.Context, n notification) (string, error) {
+	event := pagerDutyEvent{RoutingKey: p.routingKey, DedupKey: alertID(n.Rule, n.Key)}
+	switch n.Event {
+	case eventFiring:
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:   n.Title,
+			Source:    "pixie-slackbot",
+			Severity:  p.severity,
+			Timestamp: n.FiringSince.Format(time.RFC3339),
+			Component: n.Key,
+			CustomDetails: map[string]interface{}{
+				"rule":      n.Rule,
+				"condition": n.Condition,
+				"rows":      n.Rows,
+			},
+		}
+	case eventResolved:
+		event.EventAction = "resolve"
+	default:
+		// The open incident already covers the updates.
+		return n.Ref, nil
+	}
+	return "", postJSON(ctx, p.httpClient, p.url, nil, event)
+}
+
+// teamsNotifier posts message cards to a Microsoft Teams incoming webhook when alerts fire and
+// resolve.
+type teamsNotifier struct {
+	httpClient *http.Client
+	url        string
+}
+
+func (t *teamsNotifier) notify(ctx context.Context, n notification) (string, error) {
+	color := "D62728"
+	switch n.Event {
+	case eventUpdate:
+		return n.Ref, nil
+	case eventResolved:
+		color = "2CA02C"
+	}
+	card := map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    n.Title,
+		"themeColor": color,
+		"title":      n.Title,
+		"text":       toMarkdown(n.Text),
+	}
+	return "", postJSON(ctx, t.httpClient, t.url, nil, card)
+}
+
+// toMarkdown converts Slack's mrkdwn bold to standard Markdown, and breaks lines the way Teams
+// expects.
+func toMarkdown(s string) string {
+	s = strings.ReplaceAll(s, "*", "**")
+	return strings.ReplaceAll(s, "\n", "\n\n")
+}
+
+// smtpNotifier emails the alerts when they fire and resolve. The resolution is sent as a reply
+// to the firing email, so mail clients thread them.
+type smtpNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (s *smtpNotifier) notify(ctx context.Context, n notification) (string, error) {
+	if n.Event == eventUpdate {
+		return n.Ref, nil
+	}
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	messageID := fmt.Sprintf("<%s@pixie-slackbot>", hex.EncodeToString(id))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s\r\n", strings.ToUpper(n.Event), n.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", messageID)
+	if n.Ref != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\nReferences: %s\r\n", n.Ref, n.Ref)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	if err := sendMail(ctx, s.addr, host, auth, s.from, s.to, msg.Bytes()); err != nil {
+		return "", err
+	}
+	if n.Ref != "" {
+		return n.Ref, nil
+	}
+	return messageID, nil
+}
+
+// How long an email can take to send, when the context has no deadline.
+const smtpTimeout = 30 * time.Second
+
+// sendMail is smtp.SendMail, bounded by ctx: the connection is dialed with ctx and its
+// deadline is the context's.
+func sendMail(ctx context.Context, addr, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
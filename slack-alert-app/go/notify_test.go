@@ -0,0 +1,272 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingServer records the JSON bodies posted to it, and responds with status.
+type recordingServer struct {
+	*httptest.Server
+	status  int
+	bodies  []map[string]interface{}
+	headers []http.Header
+}
+
+func newRecordingServer(t *testing.T, status int) *recordingServer {
+	s := &recordingServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("reading the body: %v", err)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("invalid JSON body %q: %v", b, err)
+		}
+		s.bodies = append(s.bodies, body)
+		s.headers = append(s.headers, req.Header.Clone())
+		w.WriteHeader(s.status)
+		if s.status >= 300 {
+			w.Write([]byte("invalid payload\n"))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testNotification(event string) notification {
+	return notification{
+		Event:       event,
+		Rule:        "high-error-rate",
+		Key:         "service=px-sock-shop/carts",
+		Condition:   "error_rate > 0.05",
+		Title:       "high-error-rate is firing for service=px-sock-shop/carts",
+		Text:        "*Rule `high-error-rate` is firing*\n• error_rate=0.2",
+		Rows:        []map[string]interface{}{{"service": "px-sock-shop/carts", "error_rate": 0.2}},
+		FiringSince: time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	s := newRecordingServer(t, http.StatusOK)
+	n, err := newNotifier(notifierConfig{Name: "hook", Type: notifierWebhook, URL: s.URL, Headers: map[string]string{"Authorization": "Bearer token"}}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.notify(context.Background(), testNotification(eventFiring)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.bodies) != 1 {
+		t.Fatalf("got %d requests, want 1", len(s.bodies))
+	}
+	body := s.bodies[0]
+	for field, want := range map[string]interface{}{
+		"event":        eventFiring,
+		"rule":         "high-error-rate",
+		"key":          "service=px-sock-shop/carts",
+		"condition":    "error_rate > 0.05",
+		"firing_since": "2022-03-01T09:00:00Z",
+	} {
+		if body[field] != want {
+			t.Errorf("%s = %v, want %v", field, body[field], want)
+		}
+	}
+	if rows, ok := body["rows"].([]interface{}); !ok || len(rows) != 1 {
+		t.Errorf("rows = %v, want 1 row", body["rows"])
+	}
+	if got := s.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer token")
+	}
+	if got := s.headers[0].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	s := newRecordingServer(t, http.StatusAccepted)
+	n, err := newNotifier(notifierConfig{Name: "pd", Type: notifierPagerDuty, URL: s.URL, RoutingKey: "key"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, event := range []string{eventFiring, eventUpdate, eventResolved} {
+		if _, err := n.notify(ctx, testNotification(event)); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+	}
+	// The updates aren't sent.
+	if len(s.bodies) != 2 {
+		t.Fatalf("got %d requests, want 2", len(s.bodies))
+	}
+	trigger, resolve := s.bodies[0], s.bodies[1]
+	wantDedupKey := "high-error-rate/service=px-sock-shop/carts"
+	for _, tc := range []struct {
+		body   map[string]interface{}
+		action string
+	}{{trigger, "trigger"}, {resolve, "resolve"}} {
+		if tc.body["event_action"] != tc.action {
+			t.Errorf("event_action = %v, want %s", tc.body["event_action"], tc.action)
+		}
+		if tc.body["routing_key"] != "key" {
+			t.Errorf("routing_key = %v, want key", tc.body["routing_key"])
+		}
+		if tc.body["dedup_key"] != wantDedupKey {
+			t.Errorf("dedup_key = %v, want %s", tc.body["dedup_key"], wantDedupKey)
+		}
+	}
+	payload, ok := trigger["payload"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("trigger has no payload: %v", trigger)
+	}
+	for field, want := range map[string]interface{}{
+		"summary":   "high-error-rate is firing for service=px-sock-shop/carts",
+		"source":    "pixie-slackbot",
+		"severity":  "error",
+		"timestamp": "2022-03-01T09:00:00Z",
+		"component": "service=px-sock-shop/carts",
+	} {
+		if payload[field] != want {
+			t.Errorf("payload.%s = %v, want %v", field, payload[field], want)
+		}
+	}
+	if _, ok := resolve["payload"]; ok {
+		t.Errorf("resolve has a payload: %v", resolve)
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	s := newRecordingServer(t, http.StatusOK)
+	n, err := newNotifier(notifierConfig{Name: "teams", Type: notifierTeams, URL: s.URL}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, event := range []string{eventFiring, eventUpdate, eventResolved} {
+		if _, err := n.notify(ctx, testNotification(event)); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+	}
+	if len(s.bodies) != 2 {
+		t.Fatalf("got %d requests, want 2", len(s.bodies))
+	}
+	card := s.bodies[0]
+	for field, want := range map[string]interface{}{
+		"@type":      "MessageCard",
+		"themeColor": "D62728",
+		"title":      "high-error-rate is firing for service=px-sock-shop/carts",
+		"text":       "**Rule `high-error-rate` is firing**\n\n• error_rate=0.2",
+	} {
+		if card[field] != want {
+			t.Errorf("%s = %q, want %q", field, card[field], want)
+		}
+	}
+	if got := s.bodies[1]["themeColor"]; got != "2CA02C" {
+		t.Errorf("resolved themeColor = %v, want 2CA02C", got)
+	}
+}
+
+func TestHTTPNotifierErrors(t *testing.T) {
+	s := newRecordingServer(t, http.StatusBadRequest)
+	// A server that is closed refuses the connections.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	configs := []notifierConfig{
+		{Name: "hook", Type: notifierWebhook},
+		{Name: "pd", Type: notifierPagerDuty, RoutingKey: "key"},
+		{Name: "teams", Type: notifierTeams},
+	}
+	for _, c := range configs {
+		t.Run(c.Name, func(t *testing.T) {
+			c.URL = s.URL
+			n, err := newNotifier(c, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = n.notify(context.Background(), testNotification(eventFiring))
+			if err == nil || !strings.Contains(err.Error(), "400 Bad Request: invalid payload") {
+				t.Errorf("notify() = %v, want the status and body of the response", err)
+			}
+
+			c.URL = closed.URL
+			n, err = newNotifier(c, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := n.notify(context.Background(), testNotification(eventFiring)); err == nil {
+				t.Error("notify() succeeded with the server down")
+			}
+		})
+	}
+}
+
+func TestNotifierConfigErrors(t *testing.T) {
+	configs := []notifierConfig{
+		{Name: "hook", Type: notifierWebhook},
+		{Name: "pd", Type: notifierPagerDuty},
+		{Name: "teams", Type: notifierTeams},
+		{Name: "mail", Type: notifierSMTP, SMTPAddr: "localhost:25"},
+		{Name: "unknown", Type: "carrier-pigeon"},
+	}
+	for _, c := range configs {
+		if _, err := newNotifier(c, nil, false); err == nil {
+			t.Errorf("newNotifier(%+v) succeeded, want an error", c)
+		}
+	}
+}
+
+func TestSMTPNotifierHonorsContext(t *testing.T) {
+	// A server that accepts the connections but never greets the client.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	n, err := newNotifier(notifierConfig{Name: "mail", Type: notifierSMTP, SMTPAddr: l.Addr().String(), From: "bot@example.com", To: []string{"oncall@example.com"}}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := n.notify(ctx, testNotification(eventFiring)); err == nil {
+		t.Fatal("notify() succeeded without a greeting")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("notify() took %s, want it to stop at the context's deadline", elapsed)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// Slack's limits on the blocks of a message, see https://api.slack.com/reference/block-kit/blocks.
+const (
+	maxBlocksPerMessage = 50
+	maxSectionTextLen   = 3000
+	maxHeaderTextLen    = 150
+)
+
+// Cells longer than this are truncated to keep the rows on one line, and lines so that a section
+// fits at least the column names and one row.
+const (
+	maxCellWidth = 48
+	maxLineLen   = 1400
+)
+
+// tableMessage is a message of a rendered table. Text is the notification fallback.
+type tableMessage struct {
+	Text   string
+	Blocks []slack.Block
+}
+
+// renderTable turns a table into Block Kit messages: a header, then the rows as an aligned
+// monospace table. The values are formatted according to the semantic types of the columns.
+// Tables that don't fit Slack's limits are split across sections and messages, repeating the
+// column names in each.
+func renderTable(title string, metadata *types.TableMetadata, rows []row) []tableMessage {
+	header := slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, truncate(title, maxHeaderTextLen), false, false))
+	if len(rows) == 0 {
+		return []tableMessage{{
+			Text:   title,
+			Blocks: []slack.Block{header, slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, "_No rows._", false, false))},
+		}}
+	}
+
+	cells := make([][]string, len(rows)+1)
+	cells[0] = make([]string, len(metadata.ColInfo))
+	for i, col := range metadata.ColInfo {
+		cells[0][i] = col.Name
+	}
+	for r, rw := range rows {
+		cells[r+1] = make([]string, len(metadata.ColInfo))
+		for i, col := range metadata.ColInfo {
+			cells[r+1][i] = truncate(formatValue(col.SemanticType, rw.value(col.Name)), maxCellWidth)
+		}
+	}
+	lines := alignColumns(metadata.ColInfo, cells)
+	for i, line := range lines {
+		lines[i] = truncate(line, maxLineLen)
+	}
+
+	// Pack the rows into code blocks under the section text limit, each starting with the
+	// column names.
+	const fence = "```"
+	var sections []string
+	var sb strings.Builder
+	for _, line := range lines[1:] {
+		if sb.Len() > 0 && sb.Len()+len(line)+len(fence)+1 > maxSectionTextLen {
+			sb.WriteString(fence)
+			sections = append(sections, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() == 0 {
+			sb.WriteString(fence + "\n" + lines[0] + "\n")
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString(fence)
+	sections = append(sections, sb.String())
+
+	var messages []tableMessage
+	for i := 0; i < len(sections); i += maxBlocksPerMessage - 1 {
+		end := i + maxBlocksPerMessage - 1
+		if end > len(sections) {
+			end = len(sections)
+		}
+		text := title
+		h := slack.Block(header)
+		if i > 0 {
+			text = fmt.Sprintf("%s (continued)", title)
+			h = slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, truncate(text, maxHeaderTextLen), false, false))
+		}
+		m := tableMessage{Text: text, Blocks: []slack.Block{h}}
+		for _, s := range sections[i:end] {
+			m.Blocks = append(m.Blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, s, false, true), nil, nil))
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// alignColumns pads the cells into lines, left-aligning text and right-aligning numbers.
+func alignColumns(cols []types.ColSchema, cells [][]string) []string {
+	widths := make([]int, len(cols))
+	for _, rowCells := range cells {
+		for i, c := range rowCells {
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	lines := make([]string, len(cells))
+	for r, rowCells := range cells {
+		fields := make([]string, len(rowCells))
+		for i, c := range rowCells {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c))
+			if isNumeric(cols[i].Type) {
+				fields[i] = pad + c
+			} else {
+				fields[i] = c + pad
+			}
+		}
+		lines[r] = strings.TrimRight(strings.Join(fields, "  "), " ")
+	}
+	return lines
+}
+
+func isNumeric(t vizierpb.DataType) bool {
+	return t == vizierpb.INT64 || t == vizierpb.FLOAT64
+}
+
+// truncate shortens s to at most n runes, ending it with an ellipsis.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// formatValue formats a column value for display according to its semantic type, such as
+// durations in nanoseconds as `12.3ms` or byte counts as `1.5 MiB`.
+func formatValue(st vizierpb.SemanticType, v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		switch st {
+		case vizierpb.ST_DURATION_NS:
+			return formatDuration(v)
+		case vizierpb.ST_BYTES:
+			return formatBytes(v)
+		case vizierpb.ST_PERCENT:
+			return formatNumber(v*100) + "%"
+		case vizierpb.ST_THROUGHPUT_PER_NS:
+			return formatNumber(v*1e9) + "/s"
+		case vizierpb.ST_THROUGHPUT_BYTES_PER_NS:
+			return formatBytes(v*1e9) + "/s"
+		}
+		return formatNumber(v)
+	case string:
+		switch st {
+		case vizierpb.ST_QUANTILES:
+			return formatQuantiles(v, formatNumber)
+		case vizierpb.ST_DURATION_NS_QUANTILES:
+			return formatQuantiles(v, formatDuration)
+		}
+		return v
+	case time.Time:
+		return v.UTC().Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v)
+}
+
+// formatNumber prints integers as is, and other numbers with 3 significant digits, or rounded
+// to an integer from 1000 up.
+func formatNumber(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if math.Abs(v) >= 1000 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
+
+func formatDuration(ns float64) string {
+	d := time.Duration(ns)
+	switch {
+	case d >= time.Minute:
+		return d.Round(time.Second).String()
+	case d >= time.Second:
+		return formatNumber(ns/float64(time.Second)) + "s"
+	case d >= time.Millisecond:
+		return formatNumber(ns/float64(time.Millisecond)) + "ms"
+	case d >= time.Microsecond:
+		return formatNumber(ns/float64(time.Microsecond)) + "µs"
+	}
+	return formatNumber(ns) + "ns"
+}
+
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for math.Abs(b) >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	if i == 0 {
+		return formatNumber(math.Round(b)) + " B"
+	}
+	return strconv.FormatFloat(b, 'f', 1, 64) + " " + units[i]
+}
+
+// formatQuantiles formats the JSON quantiles that Pixie outputs, such as
+// `{"p50": 1200000, "p99": 5400000}`, as `p50=1.2ms p99=5.4ms`.
+func formatQuantiles(s string, format func(float64) string) string {
+	var q map[string]float64
+	if err := json.Unmarshal([]byte(s), &q); err != nil {
+		return s
+	}
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	// Sort p50 before p100 by the percentile rather than the name.
+	sort.Slice(names, func(i, j int) bool {
+		pi, _ := strconv.ParseFloat(strings.TrimPrefix(names[i], "p"), 64)
+		pj, _ := strconv.ParseFloat(strings.TrimPrefix(names[j], "p"), 64)
+		return pi < pj
+	})
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = name + "=" + format(q[name])
+	}
+	return strings.Join(fields, " ")
+}
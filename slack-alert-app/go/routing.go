@@ -0,0 +1,237 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routingConfig routes the alerts and table rows to the channels of the teams owning their
+// services. The owner of a service is read from the annotations of its Kubernetes Service, or
+// else of the Deployment of the same name, and else from the services of the teams.
+type routingConfig struct {
+	// Column holds the service of the rows, as `namespace/name`. It defaults to `service`.
+	Column string `yaml:"column"`
+	// FallbackChannel gets the rows of the services without an owner. It defaults to the
+	// channel of the job or notifier.
+	FallbackChannel string        `yaml:"fallback_channel"`
+	Teams           []*teamConfig `yaml:"teams"`
+	Kubernetes      struct {
+		Enabled bool `yaml:"enabled"`
+		// TeamAnnotation names the owning team, one of Teams. It defaults to `pixie.io/team`.
+		TeamAnnotation string `yaml:"team_annotation"`
+		// ChannelAnnotation names the channel of the owner directly. It defaults to
+		// `pixie.io/slack-channel`.
+		ChannelAnnotation string `yaml:"channel_annotation"`
+	} `yaml:"kubernetes"`
+}
+
+type teamConfig struct {
+	Name    string `yaml:"name"`
+	Channel string `yaml:"channel"`
+	// Services are the services the team owns, as `namespace/name` patterns such as
+	// `px-sock-shop/*`.
+	Services []string `yaml:"services"`
+}
+
+func (c *routingConfig) validate() error {
+	if c.Column == "" {
+		c.Column = "service"
+	}
+	if c.Kubernetes.TeamAnnotation == "" {
+		c.Kubernetes.TeamAnnotation = "pixie.io/team"
+	}
+	if c.Kubernetes.ChannelAnnotation == "" {
+		c.Kubernetes.ChannelAnnotation = "pixie.io/slack-channel"
+	}
+	teams := make(map[string]bool)
+	for _, t := range c.Teams {
+		if t.Name == "" || teams[t.Name] {
+			return fmt.Errorf("routing: teams need a unique name")
+		}
+		teams[t.Name] = true
+		if t.Channel == "" {
+			return fmt.Errorf("routing: team %q: channel is required", t.Name)
+		}
+		for _, pattern := range t.Services {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("routing: team %q: invalid service pattern %q", t.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// How long the owners looked up in Kubernetes are cached.
+const ownerCacheTTL = 5 * time.Minute
+
+// router finds the channels of the owners of the services.
+type router struct {
+	config routingConfig
+	// kube is nil when the annotations aren't read.
+	kube *kubeClient
+
+	mu    sync.Mutex
+	cache map[string]cachedOwner
+}
+
+type cachedOwner struct {
+	channel string
+	expires time.Time
+}
+
+func newRouter(config routingConfig) (*router, error) {
+	r := &router{config: config, cache: make(map[string]cachedOwner)}
+	if config.Kubernetes.Enabled {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("routing: %v", err)
+		}
+		r.kube = kube
+	}
+	return r, nil
+}
+
+// services returns the services of a row. Pixie outputs the services of pods behind several
+// ones as a JSON list.
+func (r *router) services(rw row) []string {
+	s, _ := rw.value(r.config.Column).(string)
+	if strings.HasPrefix(s, "[") {
+		var services []string
+		if err := json.Unmarshal([]byte(s), &services); err == nil {
+			return services
+		}
+	}
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// channel returns the channel of the owner of the row's service, or the fallback channel if it
+// has none.
+func (r *router) channel(ctx context.Context, rw row) string {
+	for _, service := range r.services(rw) {
+		if channel := r.ownerChannel(ctx, service); channel != "" {
+			return channel
+		}
+	}
+	return r.config.FallbackChannel
+}
+
+func (r *router) teamChannel(name string) string {
+	for _, t := range r.config.Teams {
+		if t.Name == name {
+			return t.Channel
+		}
+	}
+	return ""
+}
+
+// ownerChannel returns the channel of the owner of a `namespace/name` service, or "" if it has
+// none.
+func (r *router) ownerChannel(ctx context.Context, service string) string {
+	if r.kube != nil {
+		r.mu.Lock()
+		cached, ok := r.cache[service]
+		r.mu.Unlock()
+		if !ok || time.Now().After(cached.expires) {
+			channel, err := r.annotatedChannel(ctx, service)
+			if err != nil {
+				// Only the answers of the API are cached, so the lookup is retried on the next
+				// row. Keep using the expired owner meanwhile.
+				log.Printf("Failed to read the owner of %s: %v\n", service, err)
+			} else {
+				cached = cachedOwner{channel: channel, expires: time.Now().Add(ownerCacheTTL)}
+				r.mu.Lock()
+				r.cache[service] = cached
+				r.mu.Unlock()
+			}
+		}
+		if cached.channel != "" {
+			return cached.channel
+		}
+	}
+	for _, t := range r.config.Teams {
+		for _, pattern := range t.Services {
+			if ok, _ := path.Match(pattern, service); ok {
+				return t.Channel
+			}
+		}
+	}
+	return ""
+}
+
+// annotatedChannel reads the owner from the annotations of the Service, or else of the
+// Deployment of the same name. It fails if an object couldn't be read, unless the other one
+// names the owner.
+func (r *router) annotatedChannel(ctx context.Context, service string) (string, error) {
+	parts := strings.SplitN(service, "/", 2)
+	if len(parts) != 2 {
+		return "", nil
+	}
+	ns, name := url.PathEscape(parts[0]), url.PathEscape(parts[1])
+	var lookupErr error
+	for _, p := range []string{
+		fmt.Sprintf("/api/v1/namespaces/%s/services/%s", ns, name),
+		fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", ns, name),
+	} {
+		annotations, err := r.kube.annotations(ctx, p)
+		if err != nil {
+			if err != errNotFound && lookupErr == nil {
+				lookupErr = err
+			}
+			continue
+		}
+		if channel := annotations[r.config.Kubernetes.ChannelAnnotation]; channel != "" {
+			return channel, nil
+		}
+		if team := annotations[r.config.Kubernetes.TeamAnnotation]; team != "" {
+			if channel := r.teamChannel(team); channel != "" {
+				return channel, nil
+			}
+			log.Printf("%s is owned by unknown team %q.\n", service, team)
+		}
+	}
+	return "", lookupErr
+}
+
+// fanOut groups the rows by the channel of their owner. The rows without an owner and fallback
+// channel go to defaultChannel.
+func (r *router) fanOut(ctx context.Context, rows []row, defaultChannel string) (map[string][]row, []string) {
+	byChannel := make(map[string][]row)
+	var channels []string
+	for _, rw := range rows {
+		channel := r.channel(ctx, rw)
+		if channel == "" {
+			channel = defaultChannel
+		}
+		if _, ok := byChannel[channel]; !ok {
+			channels = append(channels, channel)
+		}
+		byChannel[channel] = append(byChannel[channel], rw)
+	}
+	return byChannel, channels
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"px.dev/pxapi/types"
+)
+
+// Table the rules apply to when they don't name one.
+const defaultRuleTable = "http_table"
+
+// rule is an alert condition evaluated on each row of a PxL output table. The condition is an
+// expression over the row's columns, for example:
+//
+//	error_count / total_requests > 0.05 and total_requests > 100
+//
+// See https://github.com/antonmedv/expr/blob/master/docs/Language-Definition.md for the syntax.
+type rule struct {
+	Name      string `yaml:"name"`
+	Table     string `yaml:"table"`
+	Condition string `yaml:"condition"`
+	// Key lists the columns identifying an alert, such as `service`. Each distinct key fires and
+	// resolves on its own. It defaults to the string columns of the table.
+	Key []string `yaml:"key"`
+	// Notify lists the notifiers the rule's alerts are sent to. It defaults to `slack`.
+	Notify []string `yaml:"notify"`
+	// Anomaly makes the rule fire on the rows that deviate from their history. The condition
+	// is then optional, and selects the rows that are checked.
+	Anomaly *anomaly `yaml:"anomaly"`
+	// Chart attaches a time-series chart to the rule's alerts.
+	Chart *chartConfig `yaml:"chart"`
+	// Route posts the Slack alerts in the channel of the team owning the service, rather than
+	// the notifier's channel.
+	Route bool `yaml:"route"`
+
+	program *vm.Program
+}
+
+// compile validates the rule and compiles its condition.
+func (r *rule) compile(notifiers map[string]bool) error {
+	if r.Table == "" {
+		r.Table = defaultRuleTable
+	}
+	if len(r.Notify) == 0 {
+		r.Notify = []string{defaultNotifier}
+	}
+	for _, name := range r.Notify {
+		if !notifiers[name] {
+			return fmt.Errorf("rule %q: unknown notifier %q", r.Name, name)
+		}
+	}
+	if r.Chart != nil {
+		if err := r.Chart.load(); err != nil {
+			return fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+	}
+	if r.Anomaly != nil {
+		if err := r.Anomaly.compile(); err != nil {
+			return fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+		if r.Condition == "" {
+			return nil
+		}
+	}
+	// The columns aren't known until the script runs, so the condition is only checked to
+	// evaluate to a boolean at runtime.
+	program, err := expr.Compile(r.Condition, expr.AllowUndefinedVariables())
+	if err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	r.program = program
+	return nil
+}
+
+// description describes when the rule fires.
+func (r *rule) description() string {
+	if r.Anomaly == nil {
+		return r.Condition
+	}
+	d := fmt.Sprintf("%s deviates by %s standard deviations from its %s baseline", r.Anomaly.Value,
+		formatNumber(r.Anomaly.Threshold), r.Anomaly.Method)
+	if r.Condition != "" {
+		d += " when " + r.Condition
+	}
+	return d
+}
+
+// match returns the rows of the table that satisfy the rule's condition, or all of them if it
+// has none.
+func (r *rule) match(table *tableCollector) ([]row, error) {
+	if r.program == nil {
+		return table.rows, nil
+	}
+	var matches []row
+	for _, rw := range table.rows {
+		out, err := expr.Run(r.program, rw.env())
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+		matched, ok := out.(bool)
+		if !ok {
+			return nil, fmt.Errorf("rule %q: condition returned %T, not a boolean", r.Name, out)
+		}
+		if matched {
+			matches = append(matches, rw)
+		}
+	}
+	return matches, nil
+}
+
+// row is one record of a PxL output table.
+type row struct {
+	metadata *types.TableMetadata
+	record   *types.Record
+	// anomaly is set on the rows matched by an anomaly rule.
+	anomaly *anomalyResult
+}
+
+// value returns the Go value of a column, or nil if the table has no such column.
+func (rw row) value(column string) interface{} {
+	d := rw.record.GetDatum(column)
+	if d == nil {
+		return nil
+	}
+	switch v := d.(type) {
+	case *types.BooleanValue:
+		return v.Value()
+	case *types.Int64Value:
+		// Integers are converted to floats so that dividing counts yields a ratio.
+		return float64(v.Value())
+	case *types.Float64Value:
+		return v.Value()
+	case *types.StringValue:
+		return v.Value()
+	case *types.Time64NSValue:
+		return v.Value()
+	}
+	return d.String()
+}
+
+// env returns the variables of the rule conditions: the row's columns by name. It also holds
+// the deviation of the anomalous rows, for the notifications.
+func (rw row) env() map[string]interface{} {
+	env := make(map[string]interface{}, len(rw.metadata.ColInfo))
+	for _, col := range rw.metadata.ColInfo {
+		env[col.Name] = rw.value(col.Name)
+	}
+	if rw.anomaly != nil {
+		env["anomaly"] = rw.anomaly.fields()
+	}
+	return env
+}
+
+// String formats the row as `column=value` pairs in column order, with the values formatted
+// for display.
+func (rw row) String() string {
+	fields := make([]string, len(rw.metadata.ColInfo))
+	for i, col := range rw.metadata.ColInfo {
+		fields[i] = fmt.Sprintf("%s=%s", col.Name, formatValue(col.SemanticType, rw.value(col.Name)))
+	}
+	if rw.anomaly != nil {
+		return strings.Join(fields, ", ") + ": " + rw.anomaly.String()
+	}
+	return strings.Join(fields, ", ")
+}
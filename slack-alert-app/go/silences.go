@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// silence suppresses the notifications of a rule's alerts, or of one of its keys, until it
+// expires.
+type silence struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule"`
+	// Key is empty to silence all the keys of the rule.
+	Key       string    `json:"key,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	EndsAt    time.Time `json:"ends_at"`
+}
+
+func (s *silence) matches(ruleName, key string) bool {
+	return s.Rule == ruleName && (s.Key == "" || s.Key == key)
+}
+
+func newSilenceID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// maintenanceWindow silences alerts during planned work. It is either a one-off window from
+// Start to End, or a recurring one starting on a cron Schedule and lasting Duration.
+type maintenanceWindow struct {
+	Name     string        `yaml:"name"`
+	Start    time.Time     `yaml:"start"`
+	End      time.Time     `yaml:"end"`
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// Rules lists the rules silenced by the window. It defaults to all of them.
+	Rules []string `yaml:"rules"`
+	// Key is a regular expression the silenced alert keys match, such as
+	// `service=px-sock-shop/.*`. It defaults to all the keys.
+	Key string `yaml:"key"`
+
+	schedule cron.Schedule
+	keyRe    *regexp.Regexp
+}
+
+func (m *maintenanceWindow) compile() error {
+	if m.Name == "" {
+		return fmt.Errorf("maintenance window without a name")
+	}
+	switch {
+	case m.Schedule != "" && m.Start.IsZero() && m.End.IsZero():
+		if m.Duration <= 0 {
+			return fmt.Errorf("maintenance window %q: a duration is required with a schedule", m.Name)
+		}
+		schedule, err := cron.ParseStandard(m.Schedule)
+		if err != nil {
+			return fmt.Errorf("maintenance window %q: invalid schedule %q: %v", m.Name, m.Schedule, err)
+		}
+		m.schedule = schedule
+	case m.Schedule == "" && !m.Start.IsZero() && m.End.After(m.Start):
+	default:
+		return fmt.Errorf("maintenance window %q: either a schedule and a duration, or a start before an end, are required", m.Name)
+	}
+	if m.Key != "" {
+		keyRe, err := regexp.Compile("^(?:" + m.Key + ")$")
+		if err != nil {
+			return fmt.Errorf("maintenance window %q: invalid key: %v", m.Name, err)
+		}
+		m.keyRe = keyRe
+	}
+	return nil
+}
+
+// active returns whether the window is ongoing, and when it ends.
+func (m *maintenanceWindow) active(now time.Time) (bool, time.Time) {
+	if m.schedule == nil {
+		return !now.Before(m.Start) && now.Before(m.End), m.End
+	}
+	// The window is ongoing if it started less than its duration ago.
+	start := m.schedule.Next(now.Add(-m.Duration))
+	return !start.After(now), start.Add(m.Duration)
+}
+
+func (m *maintenanceWindow) matches(ruleName, key string) bool {
+	if len(m.Rules) > 0 {
+		found := false
+		for _, name := range m.Rules {
+			found = found || name == ruleName
+		}
+		if !found {
+			return false
+		}
+	}
+	return m.keyRe == nil || m.keyRe.MatchString(key)
+}
+
+// silencedBy returns what silences an alert at time now, or "" if it isn't silenced. The caller
+// holds t.mu.
+func (t *alertTracker) silencedBy(ruleName, key string, now time.Time) string {
+	for _, s := range t.silences {
+		if s.matches(ruleName, key) && now.Before(s.EndsAt) {
+			return fmt.Sprintf("silence %s by %s", s.ID, s.CreatedBy)
+		}
+	}
+	for _, m := range t.maintenance {
+		if ok, _ := m.active(now); ok && m.matches(ruleName, key) {
+			return fmt.Sprintf("maintenance window %s", m.Name)
+		}
+	}
+	return ""
+}
+
+// expireSilences drops the silences that ended. The caller holds t.mu.
+func (t *alertTracker) expireSilences(now time.Time) {
+	silences := t.silences[:0]
+	for _, s := range t.silences {
+		if now.Before(s.EndsAt) {
+			silences = append(silences, s)
+		}
+	}
+	t.silences = silences
+}
+
+// silence suppresses the notifications of an alert for d.
+func (t *alertTracker) silence(ruleName, key, user string, d time.Duration) (*silence, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	s := &silence{ID: newSilenceID(), Rule: ruleName, Key: key, CreatedBy: user, CreatedAt: now, EndsAt: now.Add(d)}
+	t.expireSilences(now)
+	t.silences = append(t.silences, s)
+	return s, t.save()
+}
+
+// acknowledge marks a firing alert as being handled, which stops its updates until it resolves.
+func (t *alertTracker) acknowledge(ruleName, key, user string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.alerts[alertID(ruleName, key)]
+	if !ok {
+		return fmt.Errorf("the alert is no longer firing")
+	}
+	state.AckedBy = user
+	state.AckedAt = time.Now()
+	return t.save()
+}
+
+// silencesMessage lists the active silences and maintenance windows.
+func (t *alertTracker) silencesMessage() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.expireSilences(now)
+
+	var lines []string
+	for _, s := range t.silences {
+		target := fmt.Sprintf("`%s`", s.Rule)
+		if s.Key != "" {
+			target += fmt.Sprintf(" for `%s`", s.Key)
+		}
+		lines = append(lines, fmt.Sprintf("• %s: %s, by %s until %s", s.ID, target, s.CreatedBy, s.EndsAt.UTC().Format(time.RFC3339)))
+	}
+	for _, m := range t.maintenance {
+		ok, end := m.active(now)
+		if !ok {
+			continue
+		}
+		target := "all rules"
+		if len(m.Rules) > 0 {
+			target = "`" + strings.Join(m.Rules, "`, `") + "`"
+		}
+		if m.Key != "" {
+			target += fmt.Sprintf(" for keys matching `%s`", m.Key)
+		}
+		lines = append(lines, fmt.Sprintf("• Maintenance window %s: %s, until %s", m.Name, target, end.UTC().Format(time.RFC3339)))
+	}
+	if len(lines) == 0 {
+		return "No alerts are silenced."
+	}
+	sort.Strings(lines)
+	return "Silenced alerts:\n" + strings.Join(lines, "\n")
+}
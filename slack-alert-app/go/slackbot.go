@@ -19,11 +19,8 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"strings"
-	"time"
 
 	"github.com/slack-go/slack"
 	"px.dev/pxapi"
@@ -32,19 +29,30 @@ import (
 
 func main() {
 
-	// Slack channel for Slackbot to post in.
-	// Slack App must be a member of this channel.
-	slackChannel := "#pixie-alerts"
-
-	// This PxL script ouputs a table of the HTTP total requests count and
-	// HTTP error (>4xxx) count for each service in the `px-sock-shop` namespace.
-	// To deploy the px-sock-shop demo, see:
-	// https://docs.px.dev/tutorials/integrations/slackbot-alert/ for how to
-	b, err := ioutil.ReadFile("http_errors.pxl")
+	// The config file lists the jobs: the PxL scripts to run, on which schedule, and the tables
+	// to post or the alert rules to evaluate on their output. It also configures where the
+	// alerts are sent. By default, they are posted in the #pixie-alerts Slack channel, which
+	// the Slack App must be a member of.
+	configPath, ok := os.LookupEnv("CONFIG_FILE")
+	if !ok {
+		configPath = "config.yaml"
+	}
+	conf, err := loadConfig(configPath)
 	if err != nil {
 		panic(err)
 	}
-	pxlScript := string(b)
+
+	// The state of the firing alerts is kept across restarts.
+	statePath, ok := os.LookupEnv("STATE_FILE")
+	if !ok {
+		statePath = "alert-state.json"
+	}
+
+	// The history of the tables of the anomaly rules is kept in an embedded database.
+	historyPath, ok := os.LookupEnv("HISTORY_FILE")
+	if !ok {
+		historyPath = "history.db"
+	}
 
 	// The slackbot requires the following configs, which are specified
 	// using environment variables. For directions on how to find these
@@ -74,52 +82,88 @@ func main() {
 		panic(err)
 	}
 
-	slackClient := slack.New(slackToken)
-
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+	var slackOpts []slack.Option
+	// Point the bot at a local Slack API stand-in for testing.
+	if apiURL, ok := os.LookupEnv("SLACK_API_URL"); ok {
+		slackOpts = append(slackOpts, slack.OptionAPIURL(apiURL))
+	}
+	// The slash commands and the clicks on the alert buttons are received over Socket Mode,
+	// which requires an app-level token with the `connections:write` scope.
+	appToken, hasAppToken := os.LookupEnv("SLACK_APP_TOKEN")
+	if hasAppToken {
+		slackOpts = append(slackOpts, slack.OptionAppLevelToken(appToken))
+	}
+	slackClient := slack.New(slackToken, slackOpts...)
 
-	for {
-		tm := &tableMux{tables: make(map[string]*tableCollector)}
-		log.Println("Executing PxL script.")
-		resultSet, err := vz.ExecuteScript(ctx, pxlScript, tm)
+	notifiers := make(map[string]notifier)
+	for _, c := range conf.Notifiers {
+		n, err := newNotifier(c, slackClient, hasAppToken)
 		if err != nil {
 			panic(err)
 		}
+		notifiers[c.Name] = n
+	}
+	alerts, err := loadAlertTracker(statePath, notifiers, conf.Maintenance)
+	if err != nil {
+		panic(err)
+	}
 
-		log.Println("Stream PxL script results.")
-		if err := resultSet.Stream(); err != nil {
-			log.Printf("Got error: %+v, while streaming.\n", err)
-		}
+	history, err := openHistoryStore(historyPath)
+	if err != nil {
+		panic(err)
+	}
+	defer history.Close()
 
-		// Get slack message constructed from table data.
-		table := tm.GetTable("http_table").GetTableDataSync()
-		log.Println("Sending slack message.")
-		_, _, err = slackClient.PostMessage(slackChannel, slack.MsgOptionText(table, false), slack.MsgOptionAsUser(true))
-		if err != nil {
-			log.Println("Error sending to slack: " + err.Error())
+	router, err := newRouter(conf.Routing)
+	if err != nil {
+		panic(err)
+	}
+	alerts.route = router.channel
+
+	runner := &jobRunner{vz: vz, slackClient: slackClient, alerts: alerts, history: history, router: router}
+	alerts.attach = runner.alertAttachments
+	// The failures of the jobs without a channel are reported where the alerts are posted by
+	// default.
+	for _, c := range conf.Notifiers {
+		if c.Name == defaultNotifier && c.Type == notifierSlack {
+			runner.errorChannel = c.Channel
 		}
-
-		// wait for next tick
-		<-ticker.C
 	}
+	scheduler, err := runner.schedule(ctx, conf.Jobs)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Scheduled %d jobs.\n", len(conf.Jobs))
+
+	if !hasAppToken {
+		log.Println("Slash commands and alert buttons are disabled. Set SLACK_APP_TOKEN to enable them.")
+	} else {
+		go func() {
+			// The alerts keep going if the commands can't connect.
+			if err := newCommandHandler(slackClient, vz, conf.Commands, alerts).run(ctx); err != nil {
+				log.Printf("Slash commands stopped: %v\n", err)
+			}
+		}()
+	}
+	// The jobs run in the scheduler's goroutines until the process is stopped.
+	scheduler.Run()
 }
 
 // Implement the TableRecordHandler interface to processes the PxL script output table record-wise.
 type tableCollector struct {
-	tableDataBuilder strings.Builder
+	metadata types.TableMetadata
+	rows     []row
 	// Channel used to block until all of the table data to be collected.
 	done chan struct{}
 }
 
 func (t *tableCollector) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
-	t.tableDataBuilder.WriteString("*Recent 4xx+ Spikes in last 5 minutes:*\n")
+	t.metadata = metadata
 	return nil
 }
 
 func (t *tableCollector) HandleRecord(ctx context.Context, r *types.Record) error {
-	fmt.Fprintf(&t.tableDataBuilder, "`%s` \t ---> %s  (>4xx) errors out of %s requests.\n",
-		r.GetDatum("service"), r.GetDatum("error_count"), r.GetDatum("total_requests"))
+	t.rows = append(t.rows, row{metadata: &t.metadata, record: r})
 	return nil
 }
 
@@ -128,22 +172,38 @@ func (t *tableCollector) HandleDone(ctx context.Context) error {
 	return nil
 }
 
-func (t *tableCollector) GetTableDataSync() string {
-	// Wait until the `done` channel is closed, indicating table data has finished collecting.
-	<-t.done
-	return t.tableDataBuilder.String()
+// GetTableDataSync waits until the table data has finished collecting, or the context is done.
+func (t *tableCollector) GetTableDataSync(ctx context.Context) (*tableCollector, error) {
+	select {
+	case <-t.done:
+		return t, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("table %q is incomplete: %w", t.metadata.Name, ctx.Err())
+	}
 }
 
 // Implement the TableMuxer to route pxl script output tables to the correct handler.
 type tableMux struct {
 	tables map[string]*tableCollector
+	// names are the names of the tables in output order.
+	names []string
 }
 
 func (s *tableMux) AcceptTable(ctx context.Context, metadata types.TableMetadata) (pxapi.TableRecordHandler, error) {
-	s.tables[metadata.Name] = &tableCollector{done: make(chan struct{})}
+	s.tables[metadata.Name] = &tableCollector{metadata: metadata, done: make(chan struct{})}
+	s.names = append(s.names, metadata.Name)
 	return s.tables[metadata.Name], nil
 }
 
 func (s *tableMux) GetTable(tableName string) *tableCollector {
 	return s.tables[tableName]
 }
+
+// waitTable returns the data of a table once it has finished collecting.
+func (s *tableMux) waitTable(ctx context.Context, tableName string) (*tableCollector, error) {
+	t := s.GetTable(tableName)
+	if t == nil {
+		return nil, fmt.Errorf("the script did not output table %q", tableName)
+	}
+	return t.GetTableDataSync(ctx)
+}